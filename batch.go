@@ -0,0 +1,99 @@
+package vbeam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The batch endpoint runs several json procs in one round trip. The request
+// body is an array of calls:
+//
+//	[{"proc": "ProcName", "input": {...}}, ...]
+//
+// and the response is an array of results in the same order:
+//
+//	[{"data": ..., "dur": 1.25}, {"error": {...}, "dur": 0.31}, ...]
+//
+// where dur is the time spent in the proc in milliseconds. The durations are
+// also reported in the Server-Timing header as call0, call1, etc.
+//
+// Each call goes through the same path as HandleRPC, with its own Context and
+// transaction, and its input is held to the proc's MaxBytes. The whole body is
+// limited to app.MaxBatchBytes.
+
+const PATH_BATCH = "/rpc-batch"
+
+const MaxBatchCalls = 100
+
+type batchCall struct {
+	Proc  string          `json:"proc"`
+	Input json.RawMessage `json:"input"`
+}
+
+type batchResult struct {
+	Data  any     `json:"data,omitempty"`
+	Error *Error  `json:"error,omitempty"`
+	Dur   float64 `json:"dur"`
+}
+
+func (app *Application) HandleBatch(w http.ResponseWriter, request *http.Request) {
+	if app.handleCORS(w, request) {
+		return
+	}
+	if request.Method != "POST" {
+		RespondError(w, MethodNotAllowed)
+		return
+	}
+	app.ensureCSRFCookie(w, request)
+	if err := app.checkCSRF(request); err != nil {
+		RespondError(w, err)
+		return
+	}
+
+	var maxBytes = app.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	request.Body = http.MaxBytesReader(w, request.Body, int64(maxBytes))
+	var calls []batchCall
+	if err := json.NewDecoder(request.Body).Decode(&calls); err != nil || len(calls) > MaxBatchCalls {
+		RespondError(w, InvalidRequest)
+		return
+	}
+
+	var results = make([]batchResult, len(calls))
+	var timings = make([]string, 0, len(calls)+1)
+	var batchStart = time.Now()
+	for index, call := range calls {
+		var procStart = time.Now()
+		var callCtx *Context
+		output, err := app.callJSONProc(request, call.Proc, call.Input, func(ctx *Context) {
+			callCtx = ctx
+		})
+		var dur = time.Since(procStart)
+		if callCtx != nil && callCtx.committed {
+			writeCookies(w, callCtx)
+		}
+
+		var result = &results[index]
+		result.Dur = float64(dur.Microseconds()) / 1000.0
+		if err != nil {
+			result.Error = AsError(err)
+		} else {
+			result.Data = outputData(output)
+		}
+		timings = append(timings, fmt.Sprintf("call%d;dur=%f", index, result.Dur))
+	}
+
+	rw := w.(*ResponseWriter)
+	rw.procDur = time.Since(batchStart)
+
+	header := w.Header()
+	timings = append([]string{ServerTimingHeaderValue(rw.procDur)}, timings...)
+	header.Set("Server-Timing", strings.Join(timings, ", "))
+	header.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
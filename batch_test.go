@@ -0,0 +1,47 @@
+package vbeam
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func WriteShortItem(ctx *Context, input testWrite) (string, error) {
+	return WriteItem(ctx, input)
+}
+
+func postBatch(app *Application, body string) *httptest.ResponseRecorder {
+	var request = httptest.NewRequest("POST", PATH_BATCH, strings.NewReader(body))
+	var recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestBatchLimits(t *testing.T) {
+	var app = newTestApp(t)
+	RegisterProcOpts(app, WriteShortItem, ProcOptions{MaxBytes: 32})
+
+	var recorder = postBatch(app, `[
+		{"proc": "WriteShortItem", "input": {"Name": "a", "Value": "1"}},
+		{"proc": "WriteShortItem", "input": {"Name": "b", "Value": "`+strings.Repeat("x", 64)+`"}}
+	]`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the batch to run, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var results []batchResult
+	json.Unmarshal(recorder.Body.Bytes(), &results)
+	if len(results) != 2 || results[0].Error != nil || results[1].Error == nil || results[1].Error.Code != "InvalidRequest" {
+		t.Fatalf("expected only the oversized call to fail, got %s", recorder.Body.String())
+	}
+	if _, found := readTestItem(app, "b"); found {
+		t.Fatal("the oversized call ran")
+	}
+
+	app.MaxBatchBytes = 100
+	recorder = postBatch(app, `[{"proc": "WriteItem", "input": {"Name": "c", "Value": "`+strings.Repeat("x", 100)+`"}}]`)
+	if recorder.Code == http.StatusOK {
+		t.Fatal("expected a batch over MaxBatchBytes to be rejected")
+	}
+}
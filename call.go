@@ -0,0 +1,54 @@
+package vbeam
+
+import (
+	"context"
+	"reflect"
+)
+
+// Call invokes a registered proc by name from Go code (scripts, tests, other
+// services in the same process), without going through http.
+//
+// The call goes through the same path as an http call: a fresh Context and
+// transaction, the proc's options and the interceptors. The input must be of
+// the proc's input type (or nil for the zero value).
+//
+// Raw input and stream procs can't be called this way.
+func Call(app *Application, procName string, token string, input any) (any, error) {
+	return CallContext(context.Background(), app, procName, token, input)
+}
+
+// CallContext is like Call, with a parent context for cancellation
+func CallContext(parent context.Context, app *Application, procName string, token string, input any) (any, error) {
+	proc, found := app.procMap[procName]
+	if !found {
+		return nil, ProcedureNotFound
+	}
+	if proc.InputType == httpRequestPtr || proc.Stream {
+		return nil, TransportNotSupported
+	}
+
+	var inputValue reflect.Value
+	if input == nil {
+		inputValue = reflect.Zero(proc.InputType)
+	} else {
+		inputValue = reflect.ValueOf(input)
+		if inputValue.Type() != proc.InputType {
+			return nil, InvalidRequest
+		}
+	}
+
+	var ctx = newContext(app, parent, token)
+	ctx.inProcess = true
+	defer CloseContext(&ctx)
+	return app.runProc(&ctx, &proc, inputValue)
+}
+
+// Invoke is the typed version of Call. The proc must be registered on the app.
+func Invoke[Input, Output any](app *Application, proc func(*Context, Input) (Output, error), token string, input Input) (output Output, err error) {
+	var procName = _LocalProcName(reflect.ValueOf(proc))
+	result, err := Call(app, procName, token, input)
+	if result != nil {
+		output, _ = result.(Output)
+	}
+	return output, err
+}
@@ -0,0 +1,127 @@
+package vbeam
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.hasen.dev/vbolt"
+)
+
+func TestCallRunsInterceptors(t *testing.T) {
+	var app = newTestApp(t)
+	var seen []string
+	app.Intercept(func(ctx *Context, call *ProcCall, next func() (any, error)) (any, error) {
+		seen = append(seen, call.ProcName+":"+ctx.Token)
+		return next()
+	})
+	app.InterceptProc("WriteItemThenFail", func(ctx *Context, call *ProcCall, next func() (any, error)) (any, error) {
+		return nil, errors.New("Denied")
+	})
+
+	if _, err := Call(app, "WriteItem", "token", testWrite{"a", "1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := Call(app, "WriteItemThenFail", "token", testWrite{"b", "2"})
+	if AsError(err).Code != "Denied" {
+		t.Fatalf("expected the interceptor's error, got %v", err)
+	}
+	if len(seen) != 2 || seen[0] != "WriteItem:token" || seen[1] != "WriteItemThenFail:token" {
+		t.Fatalf("unexpected interceptor calls: %v", seen)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	var app = newTestApp(t)
+	if _, err := Call(app, "NoSuchProc", "", nil); !errors.Is(err, ProcedureNotFound) {
+		t.Fatalf("expected ProcedureNotFound, got %v", err)
+	}
+	if _, err := Call(app, "WriteItem", "", "wrong type"); !errors.Is(err, InvalidRequest) {
+		t.Fatalf("expected InvalidRequest, got %v", err)
+	}
+}
+
+func TestCallNilInput(t *testing.T) {
+	var app = newTestApp(t)
+	output, err := Call(app, "WriteItem", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output != "" {
+		t.Fatalf("expected the output of the zero input, got %v", output)
+	}
+	if _, found := readTestItem(app, ""); !found {
+		t.Fatal("the zero input was not passed to the proc")
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	var app = newTestApp(t)
+	output, err := Invoke(app, WriteItem, "", testWrite{"a", "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output != "1" {
+		t.Fatalf("unexpected output: %q", output)
+	}
+
+	output, err = Invoke(app, WriteItemThenFail, "", testWrite{"b", "2"})
+	if !errors.Is(err, errTestFailure) || output != "" {
+		t.Fatalf("expected TestFailure and no output, got %q, %v", output, err)
+	}
+}
+
+// a store that writes on every touch, like session.Enable's
+type touchingStore struct {
+	db      *vbolt.DB
+	touches int
+}
+
+func (s *touchingStore) LoadSession(ctx *Context) *Session {
+	return &Session{Id: ctx.Token, UserID: 1}
+}
+
+func (s *touchingStore) TouchSession(session *Session) {
+	var tx = vbolt.WriteTx(s.db)
+	defer vbolt.TxClose(tx)
+	s.touches++
+}
+
+var nestedCallApp *Application
+
+func WriteItemAndCallNested(ctx *Context, input testWrite) (string, error) {
+	UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, testItems, input.Name, &input.Value)
+	return Invoke(nestedCallApp, ReadUserItem, ctx.Token, input.Name)
+}
+
+func ReadUserItem(ctx *Context, name string) (value string, err error) {
+	vbolt.Read(ctx.Tx, testItems, name, &value)
+	return
+}
+
+func TestNestedCallDoesNotTouchSession(t *testing.T) {
+	var app = newTestApp(t)
+	var store = &touchingStore{db: app.DB}
+	app.Sessions = store
+	RegisterProc(app, WriteItemAndCallNested)
+	RegisterProcOpts(app, ReadUserItem, ProcOptions{AuthRequired: true})
+	nestedCallApp = app
+
+	var done = make(chan error, 1)
+	go func() {
+		_, err := Call(app, "WriteItemAndCallNested", "token", testWrite{"a", "1"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested call deadlocked on the write transaction")
+	}
+	if store.touches != 0 {
+		t.Fatalf("expected in-process calls not to touch the session, got %d touches", store.touches)
+	}
+}
@@ -0,0 +1,1195 @@
+package vbeam
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------
+// section: Wire formats
+// ------------------------------------------
+//
+// RPC inputs and outputs are json by default. Clients can ask for another
+// encoding by sending its content type in the Content-Type header (for the
+// input) and the Accept header (for the output). Errors are always json.
+//
+// MessagePack is available out of the box; other codecs can be added with
+// app.RegisterCodec. Streams, batches and websocket calls are always json.
+
+type Codec interface {
+	// the media type used in Content-Type and Accept headers
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var JSONCodec Codec = jsonCodec{}
+
+// MessagePackCodec encodes values like encoding/json would (same field names,
+// omitempty, custom marshalers, etc), but in MessagePack, and with []byte as
+// binary data
+var MessagePackCodec Codec = msgpackCodec{}
+
+// RegisterCodec makes the codec available for content negotiation, replacing
+// any codec with the same content type
+func (app *Application) RegisterCodec(codec Codec) {
+	for index, c := range app.codecs {
+		if c.ContentType() == codec.ContentType() {
+			app.codecs[index] = codec
+			return
+		}
+	}
+	app.codecs = append(app.codecs, codec)
+}
+
+// requestCodec picks the codec for the request body; json unless the client
+// says otherwise
+func (app *Application) requestCodec(request *http.Request) Codec {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err == nil {
+		for _, c := range app.codecs {
+			if c.ContentType() == mediaType {
+				return c
+			}
+		}
+	}
+	return JSONCodec
+}
+
+// responseCodec picks the codec for the response body from the Accept header
+func (app *Application) responseCodec(request *http.Request) Codec {
+	for _, accept := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if mediaType == JSONCodec.ContentType() {
+			return JSONCodec
+		}
+		for _, c := range app.codecs {
+			if c.ContentType() == mediaType {
+				return c
+			}
+		}
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// The MessagePack codec walks Go values with reflection, following the rules
+// of encoding/json (field names, omitempty, embedded structs, custom
+// marshalers), so both formats agree on how values look. The exceptions are
+// byte slices, which are binary rather than base64 strings.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgpackEncodeValue(&buf, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	var target = reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("msgpack: cannot decode into %T", v)
+	}
+	var d = msgpackDecoder{data: data}
+	if err := d.decodeInto(target.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errMsgpackTrailing
+	}
+	return nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// msgpackField is a struct field as encoding/json sees it
+type msgpackField struct {
+	name      string
+	index     []int // for embedded fields, the path to the field
+	omitEmpty bool
+	asString  bool // the ",string" option
+}
+
+var msgpackFieldCache sync.Map // reflect.Type -> []msgpackField
+
+// msgpackFields lists the fields of a struct type like encoding/json does:
+// exported fields by their json names, with the fields of embedded structs
+// promoted. When embedded fields share a name, the least nested one wins, or
+// the tagged one at the same depth; otherwise they're all left out.
+func msgpackFields(t reflect.Type) []msgpackField {
+	if cached, ok := msgpackFieldCache.Load(t); ok {
+		return cached.([]msgpackField)
+	}
+
+	type candidate struct {
+		field  msgpackField
+		depth  int
+		tagged bool
+	}
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var candidates []candidate
+	var visited = make(map[reflect.Type]bool)
+	var level = []embedded{{t, nil}}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []embedded
+		for _, entry := range level {
+			if visited[entry.t] {
+				continue
+			}
+			visited[entry.t] = true
+			for i := 0; i < entry.t.NumField(); i++ {
+				var sf = entry.t.Field(i)
+				var tag = sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, options, _ := strings.Cut(tag, ",")
+				var index = append(append([]int{}, entry.index...), i)
+				var ft = sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+					if name == "" && ft.Kind() == reflect.Struct {
+						next = append(next, embedded{ft, index})
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				var field = msgpackField{name: name, index: index}
+				for _, option := range strings.Split(options, ",") {
+					switch option {
+					case "omitempty":
+						field.omitEmpty = true
+					case "string":
+						switch ft.Kind() {
+						case reflect.Bool, reflect.String,
+							reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+							reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+							reflect.Float32, reflect.Float64:
+							field.asString = true
+						}
+					}
+				}
+				if field.name == "" {
+					field.name = sf.Name
+				}
+				candidates = append(candidates, candidate{field, depth, name != ""})
+			}
+		}
+		level = next
+	}
+
+	var byName = make(map[string][]candidate)
+	var names []string
+	for _, c := range candidates {
+		if byName[c.field.name] == nil {
+			names = append(names, c.field.name)
+		}
+		byName[c.field.name] = append(byName[c.field.name], c)
+	}
+	var fields []msgpackField
+	for _, name := range names {
+		var dominant []candidate
+		for _, c := range byName[name] {
+			if len(dominant) == 0 || c.depth < dominant[0].depth {
+				dominant = []candidate{c}
+			} else if c.depth == dominant[0].depth {
+				dominant = append(dominant, c)
+			}
+		}
+		if len(dominant) > 1 {
+			var tagged []candidate
+			for _, c := range dominant {
+				if c.tagged {
+					tagged = append(tagged, c)
+				}
+			}
+			dominant = tagged
+		}
+		if len(dominant) == 1 {
+			fields = append(fields, dominant[0].field)
+		}
+	}
+	// in declaration order, like encoding/json
+	sort.Slice(fields, func(a, b int) bool {
+		var ia, ib = fields[a].index, fields[b].index
+		for k := 0; k < len(ia) && k < len(ib); k++ {
+			if ia[k] != ib[k] {
+				return ia[k] < ib[k]
+			}
+		}
+		return len(ia) < len(ib)
+	})
+
+	cached, _ := msgpackFieldCache.LoadOrStore(t, fields)
+	return cached.([]msgpackField)
+}
+
+// msgpackFieldValue follows the field's index path; ok is false when it goes
+// through a nil embedded pointer. With alloc, such pointers are allocated.
+func msgpackFieldValue(v reflect.Value, index []int, alloc bool) (field reflect.Value, ok bool) {
+	for k, i := range index {
+		if k > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// msgpackIsEmpty is encoding/json's notion of empty for omitempty
+func msgpackIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+func msgpackEncodeValue(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	if depth > msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	var t = v.Type()
+	if t == timeType { // the common case of a json marshaler
+		msgpackEncodeString(buf, v.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	}
+
+	// custom marshalers, checked in the same order as encoding/json
+	var marshaler = v
+	if t.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		marshaler = v.Addr()
+	}
+	if marshaler.Type().Implements(jsonMarshalerType) {
+		if marshaler.Kind() == reflect.Pointer && marshaler.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		data, err := marshaler.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return msgpackEncodeJSON(buf, data)
+	}
+	marshaler = v
+	if t.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(t).Implements(textMarshalerType) {
+		marshaler = v.Addr()
+	}
+	if marshaler.Type().Implements(textMarshalerType) {
+		if marshaler.Kind() == reflect.Pointer && marshaler.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		text, err := marshaler.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		msgpackEncodeString(buf, string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		msgpackEncodeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		msgpackEncodeUint(buf, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		msgpackEncodeString(buf, v.String())
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return msgpackEncodeValue(buf, v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if msgpackIsBytes(t) {
+			msgpackEncodeBin(buf, v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		msgpackEncodeHeader(buf, v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := msgpackEncodeValue(buf, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return msgpackEncodeMap(buf, v, depth)
+	case reflect.Struct:
+		return msgpackEncodeStruct(buf, v, depth)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %v", t)
+	}
+	return nil
+}
+
+// msgpackIsBytes is true for the byte slices encoding/json would send as
+// base64
+func msgpackIsBytes(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+	var ptr = reflect.PointerTo(t.Elem())
+	return !ptr.Implements(jsonMarshalerType) && !ptr.Implements(textMarshalerType)
+}
+
+func msgpackEncodeStruct(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	var fields = msgpackFields(v.Type())
+	var values = make([]reflect.Value, len(fields))
+	var count = 0
+	for index, field := range fields {
+		fv, ok := msgpackFieldValue(v, field.index, false)
+		if !ok || (field.omitEmpty && msgpackIsEmpty(fv)) {
+			continue
+		}
+		values[index] = fv
+		count++
+	}
+	msgpackEncodeHeader(buf, count, 0x80, 0xde, 0xdf)
+	for index, field := range fields {
+		var fv = values[index]
+		if !fv.IsValid() {
+			continue
+		}
+		msgpackEncodeString(buf, field.name)
+		if field.asString {
+			if fv.Kind() == reflect.Pointer && fv.IsNil() {
+				buf.WriteByte(0xc0)
+				continue
+			}
+			data, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return err
+			}
+			msgpackEncodeString(buf, string(data))
+			continue
+		}
+		if err := msgpackEncodeValue(buf, fv, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func msgpackEncodeMap(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	var entries = make([]entry, 0, v.Len())
+	var iter = v.MapRange()
+	for iter.Next() {
+		key, err := msgpackMapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].key < entries[b].key }) // stable output
+	msgpackEncodeHeader(buf, len(entries), 0x80, 0xde, 0xdf)
+	for _, e := range entries {
+		msgpackEncodeString(buf, e.key)
+		if err := msgpackEncodeValue(buf, e.value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackMapKey turns map keys into strings, like encoding/json
+func msgpackMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Pointer && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type %v", k.Type())
+}
+
+// msgpackEncodeJSON converts the output of a MarshalJSON method
+func msgpackEncodeJSON(buf *bytes.Buffer, data []byte) error {
+	var decoder = json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	msgpackEncode(buf, value)
+	return nil
+}
+
+// msgpackEncode writes a value decoded from json (with UseNumber)
+func msgpackEncode(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			msgpackEncodeInt(buf, n)
+		} else if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			msgpackEncodeUint(buf, n)
+		} else {
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		msgpackEncodeString(buf, v)
+	case []any:
+		msgpackEncodeHeader(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, item := range v {
+			msgpackEncode(buf, item)
+		}
+	case map[string]any:
+		msgpackEncodeHeader(buf, len(v), 0x80, 0xde, 0xdf)
+		var keys = make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys) // stable output
+		for _, key := range keys {
+			msgpackEncodeString(buf, key)
+			msgpackEncode(buf, v[key])
+		}
+	}
+}
+
+func msgpackEncodeString(buf *bytes.Buffer, s string) {
+	var n = len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func msgpackEncodeBin(buf *bytes.Buffer, data []byte) {
+	var n = len(data)
+	switch {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(data)
+}
+
+func msgpackEncodeUint(buf *bytes.Buffer, n uint64) {
+	if n <= math.MaxInt64 {
+		msgpackEncodeInt(buf, int64(n))
+		return
+	}
+	buf.WriteByte(0xcf)
+	binary.Write(buf, binary.BigEndian, n)
+}
+
+func msgpackEncodeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// array and map headers: fix format for small sizes, then 16 and 32 bit sizes
+func msgpackEncodeHeader(buf *bytes.Buffer, n int, fix, code16, code32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+var errMsgpackTrailing = errors.New("msgpack: trailing data")
+var errMsgpackDepth = errors.New("msgpack: nesting too deep")
+
+const msgpackMaxDepth = 10000
+
+// msgpackDecoder decodes into Go values with decodeInto. Where there's no
+// static type to go by (any, or a custom UnmarshalJSON), decode produces
+// values that encoding/json can marshal: binary data becomes []byte (base64
+// in json), timestamps become time.Time, and map keys become strings.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var b = d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) decode(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgpackDepth
+	}
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	var code = b[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code&0x0f), depth)
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		var size = 1 << (code - 0xd0)
+		n, err := d.readUint(size)
+		var shift = 64 - 8*size // sign extend
+		return int64(n<<shift) >> shift, err
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.read(int(n))
+		return append([]byte{}, data...), err
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (code - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readUint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: invalid code 0x%x", code)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (any, error) {
+	b, err := d.read(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (any, error) {
+	if n > len(d.data)-d.pos { // every item takes at least one byte
+		return nil, io.ErrUnexpectedEOF
+	}
+	var items = make([]any, n)
+	for index := range items {
+		var err error
+		if items[index], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var m = make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := key.(string); ok {
+			m[s] = value
+		} else {
+			// json object keys are always strings; encoding/json parses
+			// them back into integer keyed maps
+			m[fmt.Sprint(key)] = value
+		}
+	}
+	return m, nil
+}
+
+// decodeExt only understands the timestamp extension type
+func (d *msgpackDecoder) decodeExt(n int) (any, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	var extType = int8(b[0])
+	data, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	if extType != -1 {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", extType)
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case 8:
+		var v = binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)).UTC(), nil
+	case 12:
+		var nsec = binary.BigEndian.Uint32(data[:4])
+		var sec = int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
+
+// decodeInto decodes the next value into v, converting like encoding/json
+// would from the equivalent json
+func (d *msgpackDecoder) decodeInto(v reflect.Value, depth int) error {
+	if depth > msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	if d.pos >= len(d.data) {
+		return io.ErrUnexpectedEOF
+	}
+	if d.data[d.pos] == 0xc0 { // nil only clears what can be nil
+		d.pos++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeInto(v.Elem(), depth+1)
+	}
+
+	var t = v.Type()
+	if t == timeType {
+		value, err := d.decode(depth)
+		if err != nil {
+			return err
+		}
+		switch value := value.(type) {
+		case time.Time:
+			v.Set(reflect.ValueOf(value))
+			return nil
+		case string:
+			return v.Addr().Interface().(*time.Time).UnmarshalText([]byte(value))
+		}
+		return msgpackTypeError(value, t)
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return d.decodeThroughJSON(v.Addr(), depth)
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		value, err := d.decode(depth)
+		if err != nil {
+			return err
+		}
+		if text, ok := value.(string); ok {
+			return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+		}
+		return msgpackTypeError(value, t)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			return fmt.Errorf("msgpack: cannot decode into %v", t)
+		}
+		var target = reflect.New(t)
+		if err := d.decodeThroughJSON(target, depth); err != nil {
+			return err
+		}
+		v.Set(target.Elem())
+		return nil
+	case reflect.Struct:
+		return d.decodeStruct(v, depth)
+	case reflect.Map:
+		return d.decodeMapInto(v, depth)
+	case reflect.Slice:
+		if msgpackIsBytes(t) {
+			return d.decodeBytes(v, depth)
+		}
+		n, err := d.header(0x90, 0xdc, t)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(t, n, n))
+		for i := 0; i < n; i++ {
+			if err := d.decodeInto(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Array:
+		n, err := d.header(0x90, 0xdc, t)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if i < v.Len() {
+				err = d.decodeInto(v.Index(i), depth+1)
+			} else {
+				_, err = d.decode(depth + 1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).SetZero()
+		}
+		return nil
+	}
+
+	value, err := d.decode(depth)
+	if err != nil {
+		return err
+	}
+	return msgpackSetScalar(v, value)
+}
+
+func msgpackTypeError(value any, t reflect.Type) error {
+	return fmt.Errorf("msgpack: cannot decode %T into %v", value, t)
+}
+
+// decodeThroughJSON decodes the next value generically and hands it over to
+// encoding/json, for targets with no static shape
+func (d *msgpackDecoder) decodeThroughJSON(target reflect.Value, depth int) error {
+	value, err := d.decode(depth)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target.Interface())
+}
+
+// header reads an array or map header (depending on the codes), failing for
+// anything else
+func (d *msgpackDecoder) header(fix, code16 byte, t reflect.Type) (int, error) {
+	var code = d.data[d.pos]
+	if code&0xf0 == fix {
+		d.pos++
+		return int(code & 0x0f), nil
+	}
+	if code == code16 || code == code16+1 {
+		d.pos++
+		n, err := d.readUint(2 << (code - code16))
+		if err == nil && n > uint64(len(d.data)-d.pos) { // every item takes at least one byte
+			err = io.ErrUnexpectedEOF
+		}
+		return int(n), err
+	}
+	value, err := d.decode(0)
+	if err != nil {
+		return 0, err
+	}
+	return 0, msgpackTypeError(value, t)
+}
+
+func (d *msgpackDecoder) decodeStruct(v reflect.Value, depth int) error {
+	n, err := d.header(0x80, 0xde, v.Type())
+	if err != nil {
+		return err
+	}
+	var fields = msgpackFields(v.Type())
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return err
+		}
+		var field *msgpackField
+		if name, ok := key.(string); ok {
+			for index := range fields {
+				if fields[index].name == name {
+					field = &fields[index]
+					break
+				}
+			}
+			if field == nil { // encoding/json falls back to case insensitive matching
+				for index := range fields {
+					if strings.EqualFold(fields[index].name, name) {
+						field = &fields[index]
+						break
+					}
+				}
+			}
+		}
+		var fv reflect.Value
+		if field != nil {
+			fv, _ = msgpackFieldValue(v, field.index, true)
+		}
+		if !fv.IsValid() || !fv.CanSet() { // unknown field
+			if _, err := d.decode(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.asString {
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				continue
+			}
+			text, ok := value.(string)
+			if !ok {
+				return msgpackTypeError(value, fv.Type())
+			}
+			if err := json.Unmarshal([]byte(text), fv.Addr().Interface()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeInto(fv, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeMapInto(v reflect.Value, depth int) error {
+	var t = v.Type()
+	n, err := d.header(0x80, 0xde, t)
+	if err != nil {
+		return err
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return err
+		}
+		keyValue, err := msgpackMapKeyValue(key, t.Key())
+		if err != nil {
+			return err
+		}
+		var elem = reflect.New(t.Elem()).Elem()
+		if err := d.decodeInto(elem, depth+1); err != nil {
+			return err
+		}
+		v.SetMapIndex(keyValue, elem)
+	}
+	return nil
+}
+
+// msgpackMapKeyValue converts a decoded key to the map's key type
+func msgpackMapKeyValue(key any, t reflect.Type) (reflect.Value, error) {
+	var text, isText = key.(string)
+	if !isText {
+		switch key.(type) {
+		case int64, uint64:
+			text = fmt.Sprint(key)
+		default:
+			return reflect.Value{}, msgpackTypeError(key, t)
+		}
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) && t.Kind() != reflect.String {
+		var kv = reflect.New(t)
+		err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+		return kv.Elem(), err
+	}
+	var kv = reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		kv.SetString(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || kv.OverflowInt(n) {
+			return reflect.Value{}, msgpackTypeError(key, t)
+		}
+		kv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(text, 10, 64)
+		if err != nil || kv.OverflowUint(n) {
+			return reflect.Value{}, msgpackTypeError(key, t)
+		}
+		kv.SetUint(n)
+	default:
+		return reflect.Value{}, msgpackTypeError(key, t)
+	}
+	return kv, nil
+}
+
+// decodeBytes takes binary data, or a base64 string like encoding/json
+func (d *msgpackDecoder) decodeBytes(v reflect.Value, depth int) error {
+	value, err := d.decode(depth)
+	if err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case []byte:
+		v.SetBytes(value)
+		return nil
+	case string:
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(data)
+		return nil
+	}
+	return msgpackTypeError(value, v.Type())
+}
+
+// msgpackSetScalar stores a decoded number, string or bool; numbers must fit
+// the target, and only integral numbers go into integers
+func msgpackSetScalar(v reflect.Value, value any) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.String:
+		if str, ok := value.(string); ok {
+			v.SetString(str)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		var ok bool
+		switch value := value.(type) {
+		case int64:
+			n, ok = value, true
+		case uint64:
+			n, ok = int64(value), value <= math.MaxInt64
+		case float64:
+			n, ok = int64(value), value == math.Trunc(value) && math.Abs(value) < 1<<63
+		}
+		if ok && !v.OverflowInt(n) {
+			v.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		var ok bool
+		switch value := value.(type) {
+		case int64:
+			n, ok = uint64(value), value >= 0
+		case uint64:
+			n, ok = value, true
+		case float64:
+			n, ok = uint64(value), value == math.Trunc(value) && value >= 0 && value < 1<<64
+		}
+		if ok && !v.OverflowUint(n) {
+			v.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		var ok = true
+		switch value := value.(type) {
+		case int64:
+			f = float64(value)
+		case uint64:
+			f = float64(value)
+		case float64:
+			f = value
+		default:
+			ok = false
+		}
+		if ok && !v.OverflowFloat(f) {
+			v.SetFloat(f)
+			return nil
+		}
+	}
+	return msgpackTypeError(value, v.Type())
+}
@@ -0,0 +1,165 @@
+package vbeam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testMoney struct{ cents int }
+
+func (m testMoney) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"c":%d}`, m.cents)), nil
+}
+
+func (m *testMoney) UnmarshalJSON(data []byte) error {
+	var v struct{ C int }
+	err := json.Unmarshal(data, &v)
+	m.cents = v.C
+	return err
+}
+
+type testBase struct {
+	Id   int `json:"id"`
+	Name string
+}
+
+type testCode int
+
+type testItem struct {
+	testBase
+	Title   string                `json:"title"`
+	Skip    string                `json:"-"`
+	Empty   string                `json:",omitempty"`
+	Count   int64                 `json:"count,string"`
+	Blob    []byte                `json:"blob"`
+	When    time.Time             `json:"when"`
+	WhenPtr *time.Time            `json:"whenPtr"`
+	Price   testMoney             `json:"price"`
+	Tags    []string              `json:"tags"`
+	NilTags []string              `json:"nilTags"`
+	ById    map[int]string        `json:"byId"`
+	ByCode  map[testCode][]uint16 `json:"byCode"`
+	Any     any                   `json:"any"`
+	Float   float64
+	Big     uint64
+	Small   int8
+	Array   [3]int
+}
+
+// values encoded with the msgpack codec decode to what a json round trip gives
+func TestMsgpackRoundTripMatchesJSON(t *testing.T) {
+	var now = time.Now().UTC()
+	var in = testItem{
+		testBase: testBase{Id: 7, Name: "base"},
+		Title:    "title", Skip: "skipped", Count: 1 << 40, Blob: []byte{1, 2, 3},
+		When: now, WhenPtr: &now, Price: testMoney{250}, Tags: []string{"a", "b"},
+		ById:   map[int]string{2: "two", 10: "ten"},
+		ByCode: map[testCode][]uint16{3: {1, 65535}},
+		Any:    map[string]any{"k": []any{1.5, "s", true, nil}},
+		Float:  -2.25, Big: 1<<64 - 1, Small: -100, Array: [3]int{1, 2, 3},
+	}
+
+	data, err := MessagePackCodec.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out testItem
+	if err := MessagePackCodec.Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	var expected testItem
+	jsonData, _ := json.Marshal(in)
+	json.Unmarshal(jsonData, &expected)
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("round trip differs from json:\n got  %+v\n want %+v", out, expected)
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	var tests = []struct {
+		name     string
+		value    any
+		expected []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"true", true, []byte{0xc3}},
+		{"fixint", 5, []byte{0x05}},
+		{"negative fixint", -1, []byte{0xff}},
+		{"int16", 300, []byte{0xd1, 0x01, 0x2c}},
+		{"uint64", uint64(1<<64 - 1), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"fixstr", "hi", []byte{0xa2, 'h', 'i'}},
+		{"bytes are bin", []byte{1, 2}, []byte{0xc4, 0x02, 1, 2}},
+		{"fixarray", []int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{"nil slice", []int(nil), []byte{0xc0}},
+		{"map keys are sorted", map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+		{"struct fields follow json", struct {
+			A int `json:"a"`
+			B int `json:",omitempty"`
+		}{A: 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := MessagePackCodec.Marshal(test.value)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if !bytes.Equal(data, test.expected) {
+				t.Fatalf("expected % x, got % x", test.expected, data)
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeErrors(t *testing.T) {
+	var tests = []struct {
+		name   string
+		data   []byte
+		target any
+	}{
+		{"truncated", []byte{0xa5, 'a'}, new(string)},
+		{"trailing data", []byte{0x01, 0x02}, new(int)},
+		{"out of range", []byte{0xcd, 0x01, 0x2c}, new(int8)},
+		{"wrong type", []byte{0xa1, 'a'}, new(int)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := MessagePackCodec.Unmarshal(test.data, test.target); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	var app = NewApplication("test", nil)
+	var tests = []struct {
+		contentType string
+		accept      string
+		request     Codec
+		response    Codec
+	}{
+		{"", "", JSONCodec, JSONCodec},
+		{"application/json", "application/json", JSONCodec, JSONCodec},
+		{"application/msgpack", "application/msgpack", MessagePackCodec, MessagePackCodec},
+		{"application/msgpack; charset=binary", "text/html, application/msgpack", MessagePackCodec, MessagePackCodec},
+		{"text/plain", "application/msgpack;q=0, application/json", JSONCodec, JSONCodec},
+		{"", "application/unknown", JSONCodec, JSONCodec},
+	}
+	for _, test := range tests {
+		var request = httptest.NewRequest("POST", "/rpc/Proc", nil)
+		request.Header.Set("Content-Type", test.contentType)
+		request.Header.Set("Accept", test.accept)
+		if codec := app.requestCodec(request); codec != test.request {
+			t.Errorf("Content-Type %q: expected %s, got %s", test.contentType, test.request.ContentType(), codec.ContentType())
+		}
+		if codec := app.responseCodec(request); codec != test.response {
+			t.Errorf("Accept %q: expected %s, got %s", test.accept, test.response.ContentType(), codec.ContentType())
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package vbeam
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ------------------------------------------
+// section: Compression
+// ------------------------------------------
+//
+// When enabled, responses (rpc, data, static and frontend files) are
+// compressed for clients that accept it, if they are big enough and their
+// content type is in the allowlist.
+//
+// Static and frontend files can also be compressed ahead of time: a request
+// for app.js is answered with app.js.br or app.js.gz when the sibling file
+// exists and the client accepts the encoding. This works even when
+// compression is not enabled.
+
+type CompressionOptions struct {
+	// Responses smaller than this are sent as is. Defaults to 1KB
+	MinSize int
+
+	// Content types to compress; entries ending with "/" match a prefix
+	// (e.g. "text/"). Defaults to DefaultCompressibleTypes
+	ContentTypes []string
+
+	// The standard library has no brotli encoder, so brotli is used only when
+	// this is set, e.g. to brotli.NewWriter from github.com/andybalholm/brotli.
+	// It's preferred over gzip when the client accepts both.
+	Brotli func(w io.Writer) io.WriteCloser
+}
+
+const DefaultCompressionMinSize = 1024
+
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/msgpack",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// EnableCompression compresses responses with gzip, or brotli if configured
+func (app *Application) EnableCompression(options CompressionOptions) {
+	if options.MinSize <= 0 {
+		options.MinSize = DefaultCompressionMinSize
+	}
+	if options.ContentTypes == nil {
+		options.ContentTypes = DefaultCompressibleTypes
+	}
+	app.compression = &options
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// allows the given content-coding
+func acceptsEncoding(request *http.Request, encoding string) bool {
+	var wildcard = false
+	for _, part := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		var accepted = true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			value, err := strconv.ParseFloat(q, 64)
+			accepted = err == nil && value > 0
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case encoding:
+			return accepted
+		case "*":
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+func isCompressibleType(contentType string, allowed []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, a := range allowed {
+		if strings.HasSuffix(a, "/") && strings.HasPrefix(mediaType, a) {
+			return true
+		}
+		if mediaType == a {
+			return true
+		}
+	}
+	return false
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// pooledGzipWriter returns its gzip.Writer to the pool when closed
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func newGzipWriter(w io.Writer) io.WriteCloser {
+	var gz = gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return pooledGzipWriter{gz}
+}
+
+func (p pooledGzipWriter) Close() error {
+	var err = p.Writer.Close()
+	gzipWriterPool.Put(p.Writer)
+	return err
+}
+
+// newCompressWriter returns nil if the client doesn't accept any encoding we
+// have
+func (app *Application) newCompressWriter(w http.ResponseWriter, request *http.Request) *compressWriter {
+	if app.compression == nil {
+		return nil
+	}
+	var cw = &compressWriter{ResponseWriter: w, options: app.compression}
+	if app.compression.Brotli != nil && acceptsEncoding(request, "br") {
+		cw.encoding = "br"
+		cw.newEncoder = app.compression.Brotli
+	} else if acceptsEncoding(request, "gzip") {
+		cw.encoding = "gzip"
+		cw.newEncoder = newGzipWriter
+	} else {
+		return nil
+	}
+	return cw
+}
+
+// compressWriter buffers the start of the response until it knows whether to
+// compress it: the status, content type and size are only known once the
+// handler starts writing.
+type compressWriter struct {
+	http.ResponseWriter
+	options    *CompressionOptions
+	encoding   string
+	newEncoder func(w io.Writer) io.WriteCloser
+
+	status  int
+	decided bool
+	buf     []byte
+	encoder io.WriteCloser // set when compressing
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.decided {
+		return
+	}
+	if statusCode >= 100 && statusCode < 200 { // informational; not the final response
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	cw.status = statusCode
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if !cw.eligible(p) {
+			cw.startRaw()
+		} else {
+			cw.buf = append(cw.buf, p...)
+			if len(cw.buf) >= cw.options.MinSize {
+				cw.startCompressed()
+			}
+			return len(p), nil
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) eligible(p []byte) bool {
+	header := cw.Header()
+	if cw.status != http.StatusOK || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	var contentType = header.Get("Content-Type")
+	if contentType == "" {
+		// net/http would sniff it from the first write; do it here, since it
+		// can't be sniffed from compressed bytes
+		contentType = http.DetectContentType(p)
+		header.Set("Content-Type", contentType)
+	}
+	if !isCompressibleType(contentType, cw.options.ContentTypes) {
+		return false
+	}
+	header.Add("Vary", "Accept-Encoding")
+	return true
+}
+
+func (cw *compressWriter) startRaw() {
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) startCompressed() {
+	cw.decided = true
+	header := cw.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", cw.encoding)
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.encoder = cw.newEncoder(cw.ResponseWriter)
+	cw.encoder.Write(cw.buf)
+	cw.buf = nil
+}
+
+// FlushError is used by http.ResponseController; streams flush as they go,
+// so whatever is buffered is compressed (or not) right away
+func (cw *compressWriter) FlushError() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			cw.status = http.StatusOK
+		}
+		if len(cw.buf) > 0 {
+			cw.startCompressed() // we only buffer eligible responses
+		} else {
+			cw.startRaw()
+		}
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close sends out what's still buffered; it must be called after the handler
+// returns
+func (cw *compressWriter) Close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return // nothing was written; net/http takes care of it
+		}
+		// too small to bother
+		cw.startRaw()
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+// (e.g. for hijacking websocket connections)
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+var precompressedExtensions = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// servePrecompressed serves name.br or name.gz from fsys, if one exists and
+// the client accepts it. It returns false if the caller should serve the file
+// normally.
+func servePrecompressed(fsys fs.FS, w http.ResponseWriter, request *http.Request, name string) bool {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+	var contentType = mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		return false // can't sniff the type from compressed content
+	}
+	for _, pc := range precompressedExtensions {
+		if !acceptsEncoding(request, pc.encoding) {
+			continue
+		}
+		f, err := fsys.Open(name + pc.extension)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		content, seekable := f.(io.ReadSeeker)
+		if err != nil || stat.IsDir() || !seekable {
+			continue
+		}
+		header := w.Header()
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Encoding", pc.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		http.ServeContent(w, request, name, stat.ModTime(), content)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package vbeam
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------
+// section: CORS
+// ------------------------------------------
+//
+// For frontends served from another origin than the api. The rpc, batch and
+// data endpoints answer preflight requests and add the CORS headers for
+// allowed origins.
+//
+//	app.EnableCORS(vbeam.CORSOptions{
+//		AllowedOrigins:   []string{"https://app.example.com"},
+//		AllowCredentials: true,
+//		MaxAge:           time.Hour,
+//	})
+//
+// With AllowCredentials, the allowed origins are also trusted by the CSRF
+// checks, so pages there can make calls with the authToken cookie.
+
+type CORSOptions struct {
+	// Origins like "https://app.example.com"; "https://*.example.com" matches
+	// any subdomain and "*" any origin
+	AllowedOrigins []string
+
+	// Allow requests with cookies. Can't be used with "*"
+	AllowCredentials bool
+
+	// Request headers clients may send. Defaults to DefaultCORSHeaders
+	AllowedHeaders []string
+
+	// Response headers clients may read, besides the basic ones. Defaults to
+	// DefaultCORSExposedHeaders
+	ExposedHeaders []string
+
+	// How long browsers may cache a preflight response; not sent when zero
+	MaxAge time.Duration
+}
+
+var DefaultCORSHeaders = []string{"Content-Type", "Accept", "x-auth-token", CSRFHeaderName, IdempotencyHeader}
+
+var DefaultCORSExposedHeaders = []string{"Retry-After", "Server-Timing", "Deprecation", "Idempotent-Replayed"}
+
+// EnableCORS lets pages from other origins call the application's procs
+func (app *Application) EnableCORS(options CORSOptions) {
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" && options.AllowCredentials {
+			panic("cors: AllowCredentials can't be used when any origin is allowed")
+		}
+	}
+	if options.AllowedHeaders == nil {
+		options.AllowedHeaders = DefaultCORSHeaders
+	}
+	if options.ExposedHeaders == nil {
+		options.ExposedHeaders = DefaultCORSExposedHeaders
+	}
+	app.cors = &options
+}
+
+func (options *CORSOptions) allowsOrigin(origin string) bool {
+	for _, allowed := range options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		prefix, suffix, found := strings.Cut(allowed, "*")
+		if found && len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+			strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsTrusts reports whether pages from the origin may make credentialed calls
+func (app *Application) corsTrusts(origin string) bool {
+	return app.cors != nil && app.cors.AllowCredentials && app.cors.allowsOrigin(origin)
+}
+
+// handleCORS adds the CORS headers for allowed origins. It answers preflight
+// requests itself and returns true for them; the handler should return right
+// away.
+func (app *Application) handleCORS(w http.ResponseWriter, request *http.Request) bool {
+	if app.cors == nil {
+		return false
+	}
+	var origin = request.Header.Get("Origin")
+	var preflight = request.Method == "OPTIONS" && request.Header.Get("Access-Control-Request-Method") != ""
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if origin == "" || !app.cors.allowsOrigin(origin) {
+		if preflight {
+			// no CORS headers; the browser won't make the call
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	if app.cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	} else if len(app.cors.AllowedOrigins) == 1 && app.cors.AllowedOrigins[0] == "*" {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if !preflight {
+		if len(app.cors.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(app.cors.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", "GET, POST")
+	if len(app.cors.AllowedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(app.cors.AllowedHeaders, ", "))
+	}
+	if app.cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(app.cors.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,146 @@
+package vbeam
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ------------------------------------------
+// section: CSRF protection
+// ------------------------------------------
+//
+// The token can come from the authToken cookie, which the browser attaches to
+// requests made by any site. Calls authenticated that way are checked:
+//
+//   - the Origin (or Referer) header, when the browser sends one, must be our
+//     own host or one of CSRFOptions.TrustedOrigins
+//   - rpc and batch calls must also send the x-csrf-token header, matching the
+//     csrfToken cookie (double submit). The cookie is handed out with the
+//     frontend and rpc responses; the generated TS client sends it back.
+//   - data downloads and websocket upgrades can't carry a header, so they only
+//     get the origin check
+//
+// Calls with the x-auth-token header are not checked: other sites can't set
+// it. Cookies set by procs (see ctx.SetCookie) default to SameSite=Lax.
+//
+// Pages on other trusted origins (TrustedOrigins, or CORS origins allowed
+// with credentials) can't read the csrf cookie, so their calls only need
+// the Origin header.
+
+var CSRFCheckFailed = errors.New("CSRFCheckFailed")
+
+const CSRFCookieName = "csrfToken"
+const CSRFHeaderName = "x-csrf-token"
+
+type CSRFOptions struct {
+	// Other origins allowed to make cookie authenticated calls, e.g.
+	// "https://admin.example.com"
+	TrustedOrigins []string
+
+	// Turns off the checks; only for apps that never use the authToken cookie
+	Disabled bool
+}
+
+// usesAuthCookie reports whether the token of the request comes from the
+// cookie (see MakeContext)
+func usesAuthCookie(request *http.Request) bool {
+	return request.Header.Get("x-auth-token") == "" && getCookieValue(request, "authToken") != ""
+}
+
+// checkCSRF is called by the rpc and batch endpoints before any proc runs
+func (app *Application) checkCSRF(request *http.Request) error {
+	if app.CSRF.Disabled || !usesAuthCookie(request) {
+		return nil
+	}
+	if !app.originAllowed(request) {
+		return CSRFCheckFailed
+	}
+	// pages on other trusted origins can't read our csrf cookie; the Origin
+	// header, which they can't forge, has to do
+	if origin := request.Header.Get("Origin"); origin != "" && !isOwnOrigin(request, origin) {
+		return nil
+	}
+	var cookie = getCookieValue(request, CSRFCookieName)
+	var header = request.Header.Get(CSRFHeaderName)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+		return CSRFCheckFailed
+	}
+	return nil
+}
+
+// checkCSRFOrigin is for endpoints browsers reach without our client code
+// (links, websocket upgrades), where only the origin can be checked
+func (app *Application) checkCSRFOrigin(request *http.Request) error {
+	if app.CSRF.Disabled || !usesAuthCookie(request) {
+		return nil
+	}
+	if !app.originAllowed(request) {
+		return CSRFCheckFailed
+	}
+	return nil
+}
+
+// originAllowed checks where the browser says the request comes from. Clients
+// that don't say (not browsers, mostly) are allowed.
+func (app *Application) originAllowed(request *http.Request) bool {
+	var origin = request.Header.Get("Origin")
+	if origin == "" {
+		if referer, err := url.Parse(request.Header.Get("Referer")); err == nil && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	if origin != "" {
+		if origin == "null" { // sandboxed frames, data: urls, etc
+			return false
+		}
+		return app.isTrustedOrigin(request, origin)
+	}
+	// no Origin on same origin GET requests; newer browsers still tell
+	switch request.Header.Get("Sec-Fetch-Site") {
+	case "cross-site", "same-site":
+		return false
+	}
+	return true
+}
+
+func (app *Application) isTrustedOrigin(request *http.Request, origin string) bool {
+	for _, trusted := range app.CSRF.TrustedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(trusted, "/"), origin) {
+			return true
+		}
+	}
+	return app.corsTrusts(origin) || isOwnOrigin(request, origin)
+}
+
+// isOwnOrigin compares hosts only, since behind a tls terminating proxy the
+// request itself looks like plain http
+func isOwnOrigin(request *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, request.Host)
+}
+
+// ensureCSRFCookie hands out the double submit token to clients that don't
+// have it yet
+func (app *Application) ensureCSRFCookie(w http.ResponseWriter, request *http.Request) {
+	if app.CSRF.Disabled || getCookieValue(request, CSRFCookieName) != "" {
+		return
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(b[:]),
+		Path:     "/",
+		MaxAge:   400 * 24 * 60 * 60, // the most browsers allow
+		Secure:   request.TLS != nil || request.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+		// not HttpOnly: the client has to read it
+	})
+}
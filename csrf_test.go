@@ -0,0 +1,120 @@
+package vbeam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type csrfRequest struct {
+	authHeader bool
+	authCookie bool
+	csrfCookie string
+	csrfHeader string
+	origin     string
+	referer    string
+	fetchSite  string
+}
+
+func (r csrfRequest) build() *http.Request {
+	var request = httptest.NewRequest("POST", "/rpc/WriteItem", strings.NewReader("{}"))
+	request.Host = "app.example.com"
+	if r.authHeader {
+		request.Header.Set("x-auth-token", "token")
+	}
+	if r.authCookie {
+		request.AddCookie(&http.Cookie{Name: "authToken", Value: "token"})
+	}
+	if r.csrfCookie != "" {
+		request.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: r.csrfCookie})
+	}
+	if r.csrfHeader != "" {
+		request.Header.Set(CSRFHeaderName, r.csrfHeader)
+	}
+	if r.origin != "" {
+		request.Header.Set("Origin", r.origin)
+	}
+	if r.referer != "" {
+		request.Header.Set("Referer", r.referer)
+	}
+	if r.fetchSite != "" {
+		request.Header.Set("Sec-Fetch-Site", r.fetchSite)
+	}
+	return request
+}
+
+func TestCheckCSRF(t *testing.T) {
+	var app = NewApplication("test", nil)
+	app.CSRF.TrustedOrigins = []string{"https://admin.example.com/"}
+
+	var tests = []struct {
+		name    string
+		request csrfRequest
+		allowed bool
+	}{
+		{"no token", csrfRequest{}, true},
+		{"header token", csrfRequest{authHeader: true, origin: "https://evil.example"}, true},
+		{"cookie without csrf token", csrfRequest{authCookie: true}, false},
+		{"cookie with matching csrf token", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc"}, true},
+		{"cookie with wrong csrf token", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abd"}, false},
+		{"csrf header without cookie", csrfRequest{authCookie: true, csrfHeader: "abc"}, false},
+		{"own origin", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc", origin: "https://app.example.com"}, true},
+		{"other origin", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc", origin: "https://evil.example"}, false},
+		{"null origin", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc", origin: "null"}, false},
+		{"other referer", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc", referer: "https://evil.example/page"}, false},
+		{"cross site fetch", csrfRequest{authCookie: true, csrfCookie: "abc", csrfHeader: "abc", fetchSite: "cross-site"}, false},
+		{"trusted origin needs no csrf token", csrfRequest{authCookie: true, origin: "https://admin.example.com"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err = app.checkCSRF(test.request.build())
+			if test.allowed && err != nil {
+				t.Fatalf("expected the request to be allowed, got %v", err)
+			}
+			if !test.allowed && err != CSRFCheckFailed {
+				t.Fatalf("expected CSRFCheckFailed, got %v", err)
+			}
+		})
+	}
+
+	app.CSRF.Disabled = true
+	if err := app.checkCSRF(csrfRequest{authCookie: true, origin: "https://evil.example"}.build()); err != nil {
+		t.Fatalf("expected no check when disabled, got %v", err)
+	}
+}
+
+func TestCheckCSRFOrigin(t *testing.T) {
+	var app = NewApplication("test", nil)
+	if err := app.checkCSRFOrigin(csrfRequest{authCookie: true}.build()); err != nil {
+		t.Fatalf("expected a cookie call without csrf token to pass the origin check, got %v", err)
+	}
+	if err := app.checkCSRFOrigin(csrfRequest{authCookie: true, origin: "https://evil.example"}.build()); err != CSRFCheckFailed {
+		t.Fatalf("expected CSRFCheckFailed, got %v", err)
+	}
+}
+
+func TestRPCHandsOutAndChecksCSRFCookie(t *testing.T) {
+	var app = newTestApp(t)
+
+	var recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, csrfRequest{authCookie: true}.build())
+	if recorder.Code == http.StatusOK {
+		t.Fatal("cookie authenticated call without csrf token succeeded")
+	}
+	var csrfCookie *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == CSRFCookieName {
+			csrfCookie = cookie
+		}
+	}
+	if csrfCookie == nil || csrfCookie.Value == "" || csrfCookie.HttpOnly {
+		t.Fatalf("expected a csrf cookie readable by the client, got %v", csrfCookie)
+	}
+
+	recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, csrfRequest{authCookie: true, csrfCookie: csrfCookie.Value, csrfHeader: csrfCookie.Value}.build())
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the call to succeed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -152,8 +152,7 @@ func PrintFileQuote(buf io.Writer, fq FileQuote) {
 		} else {
 			codeColor.Fprint(buf, line.Text)
 		}
-		fmt.Println(buf)
-		fmt.Println(buf)
+		fmt.Fprintln(buf)
 	}
 }
 
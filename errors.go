@@ -0,0 +1,141 @@
+package vbeam
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"strconv"
+)
+
+var InvalidRequest = errors.New("InvalidRequest")
+var MethodNotAllowed = errors.New("RPC calls must be POST")
+var NotAuthenticated = errors.New("NotAuthenticated")
+var RequestTimeout = errors.New("RequestTimeout")
+var RequestCancelled = errors.New("RequestCancelled")
+var InternalServerError = errors.New("InternalServerError")
+
+// raw input and stream procs can only be called over their own http endpoint
+var TransportNotSupported = errors.New("TransportNotSupported")
+
+// the codes of our own errors, for the BuiltinErrorCode type of the TS client
+// runtime; apps get their own codes in the ErrorCode type of their bindings
+var builtinErrors = []error{
+	InvalidRequest, MethodNotAllowed, NotAuthenticated, RequestTimeout,
+	RequestCancelled, InternalServerError, TransportNotSupported,
+	ProcedureNotFound, ValidationFailed, RateLimited, CSRFCheckFailed,
+	IdempotencyConflict, IdempotencyKeyReused,
+}
+
+// http status codes for our own errors that should not be sent as 400
+var errorStatusCodes = map[error]int{
+	NotAuthenticated: http.StatusUnauthorized,
+	RequestTimeout:   http.StatusRequestTimeout,
+	RequestCancelled: 499, // client closed request
+	RateLimited:      http.StatusTooManyRequests,
+	CSRFCheckFailed:  http.StatusForbidden,
+
+	IdempotencyConflict:  http.StatusConflict,
+	IdempotencyKeyReused: http.StatusUnprocessableEntity,
+
+	InternalServerError: http.StatusInternalServerError,
+}
+
+// Error is the envelope sent to the client when a procedure fails.
+//
+// Procs can return plain errors (usually `errors.New` vars declared at the
+// package level) and they will be converted to this form, with the error
+// message as the code. Return an *Error directly to attach field errors or
+// extra details.
+type Error struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Details any               `json:"details,omitempty"`
+
+	// seconds until the call can be retried, for RateLimited errors; also
+	// sent as the Retry-After header
+	RetryAfter int `json:"retryAfter,omitempty"`
+
+	// http status code; 400 when not set
+	Status int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Code
+}
+
+// Is makes errors.Is(e, SomeSentinel) work when the code came from the sentinel
+func (e *Error) Is(target error) bool {
+	return target != nil && e.Code == target.Error()
+}
+
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// WithField returns a copy of the error with an error message attached to the
+// given input field (use the json name of the field)
+func (e *Error) WithField(name string, message string) *Error {
+	var n = *e
+	n.Fields = maps.Clone(e.Fields)
+	if n.Fields == nil {
+		n.Fields = make(map[string]string)
+	}
+	n.Fields[name] = message
+	return &n
+}
+
+// WithDetails returns a copy of the error with the details attached. The
+// details must be json serializable.
+func (e *Error) WithDetails(details any) *Error {
+	var n = *e
+	n.Details = details
+	return &n
+}
+
+// AsError converts any error to the envelope we send to clients.
+//
+// For wrapped errors, the code is taken from the innermost error, so
+// fmt.Errorf("%w: ...", SomeSentinel) still reports the sentinel's code.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var root = err
+	for inner := errors.Unwrap(err); inner != nil; inner = errors.Unwrap(inner) {
+		root = inner
+	}
+	return &Error{Code: root.Error(), Message: err.Error(), Status: sentinelStatusCode(root)}
+}
+
+func sentinelStatusCode(err error) int {
+	// don't index the map directly: it panics if err's type is not hashable
+	for sentinel, status := range errorStatusCodes {
+		if err == sentinel {
+			return status
+		}
+	}
+	return 0
+}
+
+func (e *Error) statusCode() int {
+	if e.Status == 0 {
+		return http.StatusBadRequest
+	}
+	return e.Status
+}
+
+func RespondError(w http.ResponseWriter, err error) {
+	var e = AsError(err)
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.statusCode())
+	json.NewEncoder(w).Encode(e)
+}
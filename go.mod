@@ -11,6 +11,7 @@ require (
 	go.hasen.dev/generic v0.1.2
 	go.hasen.dev/term v0.1.0
 	go.hasen.dev/vbolt v0.2.1
+	go.hasen.dev/vpack v0.2.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
@@ -18,7 +19,6 @@ require (
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	go.hasen.dev/vpack v0.2.0 // indirect
 	golang.org/x/sync v0.9.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/term v0.26.0 // indirect
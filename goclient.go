@@ -0,0 +1,365 @@
+package vbeam
+
+import (
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ------------------------------------------
+// section: Go client generation
+// ------------------------------------------
+//
+// GenerateGoClient writes a Go package for calling the app's procs over http
+// from other Go programs (services, CLI tools). It has one method per proc on
+// a Client type, and copies of all the input and output types (with the same
+// json tags, so they are wire compatible).
+//
+// Types keep their names, unless that name is taken by the client itself
+// (Client, New, Error) or by a type from another package; those get their
+// package name as a prefix, e.g. billing.Error becomes BillingError. Types
+// with their own json (or text) encoding can't be copied, so they become
+// json.RawMessage.
+
+// GenerateGoClient writes the client package source to targetFile
+func GenerateGoClient(app *Application, targetFile string, packageName string) {
+	if targetFile == "" {
+		fmt.Println("WARNING: targetFile not specified for", app.Name)
+		return
+	}
+
+	log.Println("Writing Go client:", targetFile)
+	var gen goClientGen
+	var source = gen.generate(app, packageName)
+	formatted, err := format.Source(source)
+	if err != nil {
+		// write it anyway so the problem can be inspected
+		log.Println("Go client formatting failed:", err)
+		formatted = source
+	}
+	if err := os.WriteFile(targetFile, formatted, 0644); err != nil {
+		panic(err)
+	}
+}
+
+type goClientGen struct {
+	queued   []reflect.Type
+	names    map[reflect.Type]string
+	taken    map[string]bool
+	usesTime bool
+}
+
+// names declared by goClientRuntime
+var goClientReserved = []string{"Client", "New", "Error", "decodeOutput"}
+
+var goIdentifierInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+func (g *goClientGen) generate(app *Application, packageName string) []byte {
+	g.names = make(map[reflect.Type]string)
+	g.taken = make(map[string]bool)
+	for _, name := range goClientReserved {
+		g.taken[name] = true
+	}
+
+	var methods strings.Builder
+	for _, name := range app.procList {
+		proc := app.procMap[name]
+		g.writeMethod(&methods, &proc)
+	}
+
+	var types strings.Builder
+	for len(g.queued) > 0 {
+		var t = g.queued[0]
+		g.queued = g.queued[1:]
+		fmt.Fprintf(&types, "type %s %s\n\n", g.names[t], g.underlyingExpr(t))
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "// Code generated by vbeam for %s. DO NOT EDIT.\n\n", app.Name)
+	fmt.Fprintf(&out, "package %s\n\n", packageName)
+	fmt.Fprintln(&out, "import (")
+	for _, pkg := range []string{"bufio", "bytes", "context", "encoding/json", "io", "net/http", "strings"} {
+		fmt.Fprintf(&out, "\t%q\n", pkg)
+	}
+	if g.usesTime {
+		fmt.Fprintf(&out, "\t%q\n", "time")
+	}
+	fmt.Fprintln(&out, ")")
+	out.WriteString(goClientRuntime)
+	out.WriteString(methods.String())
+	out.WriteString(types.String())
+	return []byte(out.String())
+}
+
+func (g *goClientGen) writeMethod(w *strings.Builder, proc *ProcedureInfo) {
+	if proc.Options.Description != "" {
+		for _, line := range strings.Split(proc.Options.Description, "\n") {
+			fmt.Fprintf(w, "// %s\n", line)
+		}
+	}
+	if proc.Options.Deprecated {
+		if proc.Options.Description != "" {
+			fmt.Fprintln(w, "//")
+		}
+		fmt.Fprintln(w, "// Deprecated: see the server documentation.")
+	}
+
+	var outputType = "string" // text outputs
+	if proc.Stream || !isPlainTextType(proc.OutputType) {
+		outputType = g.typeExpr(proc.OutputType)
+	}
+	switch {
+	case proc.Stream:
+		var inputType = g.typeExpr(proc.InputType)
+		fmt.Fprintf(w, "func (c *Client) %s(ctx context.Context, input %s, handle func(%s) error) error {\n", proc.ProcName, inputType, outputType)
+		fmt.Fprintf(w, "\treturn c.stream(ctx, %q, input, func(data json.RawMessage) error {\n", proc.ProcName)
+		fmt.Fprintf(w, "\t\tvar item %s\n", outputType)
+		fmt.Fprintf(w, "\t\tif err := json.Unmarshal(data, &item); err != nil {\n\t\t\treturn err\n\t\t}\n")
+		fmt.Fprintf(w, "\t\treturn handle(item)\n")
+		fmt.Fprintf(w, "\t})\n}\n\n")
+
+	case proc.InputType == httpRequestPtr:
+		fmt.Fprintf(w, "func (c *Client) %s(ctx context.Context, body io.Reader) (output %s, err error) {\n", proc.ProcName, outputType)
+		fmt.Fprintf(w, "\terr = c.callRaw(ctx, %q, body, &output)\n", proc.ProcName)
+		fmt.Fprintf(w, "\treturn\n}\n\n")
+
+	default:
+		var inputType = g.typeExpr(proc.InputType)
+		fmt.Fprintf(w, "func (c *Client) %s(ctx context.Context, input %s) (output %s, err error) {\n", proc.ProcName, inputType, outputType)
+		fmt.Fprintf(w, "\terr = c.call(ctx, %q, input, &output)\n", proc.ProcName)
+		fmt.Fprintf(w, "\treturn\n}\n\n")
+	}
+}
+
+// typeExpr returns the Go expression for t in the generated package, queuing
+// named types for declaration
+func (g *goClientGen) typeExpr(t reflect.Type) string {
+	if t == timeType {
+		g.usesTime = true
+		return "time.Time"
+	}
+	if hasCustomJSON(t) {
+		return "json.RawMessage"
+	}
+	if t.Name() != "" {
+		if t.PkgPath() == "" { // builtin
+			return t.Name()
+		}
+		return g.typeName(t)
+	}
+	return g.underlyingExpr(t)
+}
+
+// typeName decides the name of a named type in the generated package, and
+// queues it for declaration
+func (g *goClientGen) typeName(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	var name = goIdentifierInvalid.ReplaceAllString(t.Name(), "_") // e.g. generic types
+	if g.taken[name] {
+		var pkgName = t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		pkgName = goIdentifierInvalid.ReplaceAllString(pkgName, "_")
+		name = strings.ToUpper(pkgName[:1]) + pkgName[1:] + name
+		for base, n := name, 2; g.taken[name]; n++ {
+			name = fmt.Sprintf("%s%d", base, n)
+		}
+	}
+	g.names[t] = name
+	g.taken[name] = true
+	g.queued = append(g.queued, t)
+	return name
+}
+
+// hasCustomJSON reports whether values of type t don't look like their Go
+// type on the wire
+func hasCustomJSON(t reflect.Type) bool {
+	for _, i := range []reflect.Type{jsonMarshalerType, textMarshalerType} {
+		if t.Implements(i) || reflect.PointerTo(t).Implements(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *goClientGen) underlyingExpr(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + g.typeExpr(t.Elem())
+	case reflect.Slice:
+		return "[]" + g.typeExpr(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), g.typeExpr(t.Elem()))
+	case reflect.Map:
+		var keyExpr = "string" // text marshaled keys
+		if !hasCustomJSON(t.Key()) {
+			keyExpr = g.typeExpr(t.Key())
+		}
+		return fmt.Sprintf("map[%s]%s", keyExpr, g.typeExpr(t.Elem()))
+	case reflect.Struct:
+		var b strings.Builder
+		b.WriteString("struct {\n")
+		for index := 0; index < t.NumField(); index++ {
+			var field = t.Field(index)
+			if !field.IsExported() && !field.Anonymous {
+				continue
+			}
+			if field.Anonymous {
+				fmt.Fprintf(&b, "\t%s", g.typeExpr(field.Type))
+			} else {
+				fmt.Fprintf(&b, "\t%s %s", field.Name, g.typeExpr(field.Type))
+			}
+			if jsonTag, ok := field.Tag.Lookup("json"); ok {
+				fmt.Fprintf(&b, " `json:%q`", jsonTag)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}")
+		return b.String()
+	case reflect.Interface:
+		return "any"
+	default:
+		return t.Kind().String()
+	}
+}
+
+const goClientRuntime = `
+type Client struct {
+	// e.g. "https://example.com"
+	BaseURL string
+
+	// sent as the x-auth-token header
+	Token string
+
+	// http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+func New(baseURL string, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Error is the error envelope sent by the server when a call fails
+type Error struct {
+	Code    string            ` + "`json:\"code\"`" + `
+	Message string            ` + "`json:\"message\"`" + `
+	Fields  map[string]string ` + "`json:\"fields,omitempty\"`" + `
+	Details json.RawMessage   ` + "`json:\"details,omitempty\"`" + `
+
+	// seconds until the call can be retried, for RateLimited errors
+	RetryAfter int ` + "`json:\"retryAfter,omitempty\"`" + `
+
+	// the http status code of the response
+	Status int ` + "`json:\"-\"`" + `
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Code
+}
+
+func (c *Client) do(ctx context.Context, procName string, body io.Reader, contentType string, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(c.BaseURL, "/")+"/rpc/"+procName, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.Token != "" {
+		req.Header.Set("x-auth-token", c.Token)
+	}
+	var httpClient = c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e Error
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &e); err != nil || e.Code == "" {
+			e.Code = string(data)
+		}
+		e.Status = resp.StatusCode
+		return nil, &e
+	}
+	return resp, nil
+}
+
+func decodeOutput(resp *http.Response, output any) error {
+	defer resp.Body.Close()
+	if str, ok := output.(*string); ok && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		data, err := io.ReadAll(resp.Body)
+		*str = string(data)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+func (c *Client) call(ctx context.Context, procName string, input any, output any) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, procName, bytes.NewReader(body), "application/json", "")
+	if err != nil {
+		return err
+	}
+	return decodeOutput(resp, output)
+}
+
+func (c *Client) callRaw(ctx context.Context, procName string, body io.Reader, output any) error {
+	resp, err := c.do(ctx, procName, body, "application/octet-stream", "")
+	if err != nil {
+		return err
+	}
+	return decodeOutput(resp, output)
+}
+
+func (c *Client) stream(ctx context.Context, procName string, input any, handle func(data json.RawMessage) error) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, procName, bytes.NewReader(body), "application/json", "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var scanner = bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line = scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var msg struct {
+			Data  json.RawMessage ` + "`json:\"data\"`" + `
+			Error *Error          ` + "`json:\"error\"`" + `
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if err := handle(msg.Data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+`
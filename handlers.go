@@ -2,7 +2,8 @@ package vbeam
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -42,52 +43,95 @@ func (w *ResponseWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
-func RespondError(w http.ResponseWriter, err error) {
-	w.WriteHeader(400)
-	fmt.Fprintf(w, err.Error())
+func (w *ResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 { // implicit WriteHeader(200)
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func ServerTimingHeaderValue(dur time.Duration) string {
 	return fmt.Sprintf("proc;dur=%f", float64(dur.Microseconds())/1000.0)
 }
 
+// Respond writes the output of a proc as json. Any output type accepted by
+// RegisterProc can be encoded; nil pointers, slices and maps become null.
+// Strings and fmt.Stringer values (other than structs) are sent as text/plain.
 func Respond(w *ResponseWriter, object interface{}) {
-	var t = reflect.TypeOf(object)
-	header := w.Header()
+	RespondWith(w, JSONCodec, object)
+}
+
+// RespondWith is like Respond, but encodes the output with the given codec
+func RespondWith(w *ResponseWriter, codec Codec, object interface{}) {
+	// encode before writing anything, so failures can still be reported
+	contentType, data, err := encodeOutput(codec, object)
+	if err != nil {
+		log.Printf("could not encode output of type %T: %v", object, err)
+		RespondError(w, InternalServerError)
+		return
+	}
+	respondEncoded(w, contentType, data)
+}
 
+func respondEncoded(w *ResponseWriter, contentType string, data []byte) {
+	header := w.Header()
 	header.Set("Server-Timing", ServerTimingHeaderValue(w.procDur))
+	header.Set("Content-Type", contentType)
+	w.Write(data)
+}
 
-	if t.Kind() == reflect.Struct { // TODO should we handle maps the same way?
-		header.Set("Content-Type", "application/json")
-		var enc = json.NewEncoder(w)
-		enc.Encode(object)
-		return
+// encodeOutput encodes the output of a proc. Strings and fmt.Stringer values
+// (other than structs) are sent as plain text where json is wanted.
+func encodeOutput(codec Codec, object any) (contentType string, data []byte, err error) {
+	if text, ok := plainTextOutput(object); ok {
+		if codec == JSONCodec {
+			return "text/plain; charset=utf-8", []byte(text), nil
+		}
+		object = text
 	}
+	data, err = codec.Marshal(object)
+	return codec.ContentType(), data, err
+}
 
+// plainTextOutput returns the text of outputs that are sent as text
+func plainTextOutput(object any) (string, bool) {
+	if object == nil || !isPlainTextType(reflect.TypeOf(object)) {
+		return "", false
+	}
 	if s, ok := object.(fmt.Stringer); ok {
-		header.Set("Content-Type", "text/plain")
-		fmt.Fprint(w, s.String())
-		return
+		return s.String(), true
 	}
+	return object.(string), true
+}
 
-	if str, ok := object.(string); ok {
-		header.Set("Content-Type", "text/plain")
-		fmt.Fprint(w, str)
-		return
+// outputData is the output as it goes in a json message (batches, websockets),
+// matching what the call would respond with over http
+func outputData(object any) any {
+	if text, ok := plainTextOutput(object); ok {
+		return text
 	}
+	return object
+}
 
-	/*
-		if s, ok := object.(io.Writer); ok {
-			// TODO: should we really set it to plain/text? What if it's a different file?
-			header.Set("Content-Type", "text/plain")
-			ctx.Write(s)
-			return
-		}
-	*/
+var stringType = reflect.TypeOf("")
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
 
-	w.WriteHeader(500)
-	fmt.Fprintf(w, "INTERNAL PROGRAMMING ERROR")
-	// panic(errors.New(fmt.Sprintf("Don't know how to serve %#v", object)))
+// isPlainTextType reports whether outputs of type t are sent as text; clients
+// get them as strings
+func isPlainTextType(t reflect.Type) bool {
+	if t == stringType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Pointer, reflect.Interface:
+		return false
+	}
+	return t.Implements(stringerType)
 }
 
 type ContentDownload struct {
@@ -134,18 +178,19 @@ func postProcess(w *ResponseWriter, request *http.Request, start time.Time) {
 		code = 200
 	}
 
-	remoteAddr := request.RemoteAddr
-	if strings.HasPrefix(remoteAddr, "[::1]:") { // proxy!
-		// fmt.Println(request.Header.Write(os.Stdout))
-		remoteAddr = request.Header.Get("X-Forwarded-For")
-	}
+	remoteAddr := clientAddr(request)
 
 	var buf strings.Builder
 
 	// handle panics first - we can't assume by default things went ok
 	if crash := recover(); crash != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Server Error")
+		// procs have their own recovery (see callProc); this is for panics in
+		// the handlers themselves. If the response has started, it's too late
+		// to send an error.
+		if w.statusCode == 0 {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Server Error")
+		}
 		warningRed.Fprint(&buf, "\n")
 		warningRed.Fprint(&buf, "=======================================\n")
 		warningRed.Fprint(&buf, "   ******* Handler panicked! *******   \n")
@@ -181,6 +226,12 @@ func postProcess(w *ResponseWriter, request *http.Request, start time.Time) {
 func (app *Application) ServeHTTP(wp http.ResponseWriter, request *http.Request) {
 	start := time.Now()
 	var w = WrapHttpResponeWriter(wp)
+	if cw := app.newCompressWriter(w.ResponseWriter, request); cw != nil {
+		w.ResponseWriter = cw
+		// deferred first so it runs last, after postProcess has had a chance
+		// to write the panic response
+		defer cw.Close()
+	}
 	defer postProcess(w, request, start)
 
 	app.ServeMux.ServeHTTP(w, request)
@@ -201,6 +252,9 @@ func isExt(path string) bool {
 }
 
 func (app *Application) HandleRoot(w http.ResponseWriter, request *http.Request) {
+	if !isExt(request.URL.Path) { // a page, not an asset
+		app.ensureCSRFCookie(w, request)
+	}
 	serveSPA(app.Frontend, w, request)
 }
 
@@ -217,14 +271,31 @@ func serveSPA(frontend fs.FS, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=86400") // 24 hours in seconds
 	}
 
+	var name = strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if (err == nil || name == "index.html") && servePrecompressed(frontend, w, r, name) {
+		return
+	}
+
 	server.ServeHTTP(w, r)
 }
 
 var ProcedureNotFound = errors.New("Procedure Not Found")
 
 func (app *Application) HandleRPC(w http.ResponseWriter, request *http.Request) {
+	if app.handleCORS(w, request) {
+		return
+	}
 	if request.Method != "POST" {
-		RespondError(w, errors.New("RPC calls must be POST"))
+		RespondError(w, MethodNotAllowed)
+		return
+	}
+
+	app.ensureCSRFCookie(w, request)
+	if err := app.checkCSRF(request); err != nil {
+		RespondError(w, err)
 		return
 	}
 
@@ -237,55 +308,177 @@ func (app *Application) HandleRPC(w http.ResponseWriter, request *http.Request)
 
 	request.Body = http.MaxBytesReader(w, request.Body, int64(proc.MaxBytes))
 
-	var output []reflect.Value
+	if proc.Options.Deprecated {
+		w.Header().Set("Deprecation", "true")
+		log.Println("WARNING: deprecated procedure called:", proc.ProcName)
+	}
 
-	var procStart time.Time
+	var idempotent *idempotentCall
+	if !proc.Stream {
+		var done bool
+		idempotent, done = app.startIdempotentCall(w, request, proc.ProcName)
+		if done {
+			return
+		}
+		if idempotent != nil {
+			defer app.releaseIdempotentCall(idempotent)
+		}
+	}
+
+	var input reflect.Value
 	if proc.InputType == httpRequestPtr { // non-json body
-		procStart = time.Now()
 		// let the proc process its own input
-		func() { // Go version of a scoped defer
-			var context = MakeContext(app, request)
-			defer CloseContext(&context)
-			var args = []reflect.Value{
-				reflect.ValueOf(&context),
-				reflect.ValueOf(request),
-			}
-			output = proc.ProcValue.Call(args)
-		}()
+		input = reflect.ValueOf(request)
 	} else { // json body
-		var decoder = json.NewDecoder(request.Body)
-		// parse the input json into a struct
-		var requestObject = reflect.New(proc.InputType)
-		var err = decoder.Decode(requestObject.Interface())
+		var err error
+		input, err = decodeInput(&proc, app.requestCodec(request), request.Body)
 		if err != nil {
-			fmt.Println("error decoding request json")
-			RespondError(w, errors.New("InvalidRequest"))
+			fmt.Println("error decoding request input")
+			RespondError(w, err)
 			return
 		}
-		procStart = time.Now()
-		func() { // Go version of a scoped defer
-			var context = MakeContext(app, request)
-			defer CloseContext(&context)
+	}
 
-			var args = []reflect.Value{
-				reflect.ValueOf(&context),
-				requestObject.Elem(),
-			}
-			output = proc.ProcValue.Call(args)
-		}()
+	if proc.Stream {
+		app.handleStream(w.(*ResponseWriter), request, &proc, input)
+		return
 	}
 
+	var output any
+	var err error
+	procStart := time.Now()
+	func() { // Go version of a scoped defer
+		var ctx = MakeContext(app, request)
+		defer CloseContext(&ctx)
+		ctx.idempotent = idempotent
+		output, err = app.runProc(&ctx, &proc, input)
+		if ctx.committed {
+			writeCookies(w, &ctx)
+		}
+	}()
+
 	rw := w.(*ResponseWriter)
 	rw.procDur = time.Since(procStart)
+	rw.Header().Add("Vary", "Accept")
 	// check if error was returned
-	if output[1].IsNil() {
-		Respond(rw, output[0].Interface())
+	if err == nil {
+		if idempotent != nil { // encoded when it was stored
+			respondEncoded(rw, idempotent.contentType, idempotent.body)
+		} else {
+			RespondWith(rw, app.responseCodec(request), output)
+		}
 	} else {
-		var err = output[1].Interface().(error)
 		RespondError(w, err)
 	}
 }
 
+// decodeInput parses the input of a proc into a value of its input type
+func decodeInput(proc *ProcedureInfo, codec Codec, r io.Reader) (reflect.Value, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return reflect.Value{}, InvalidRequest
+	}
+	var requestObject = reflect.New(proc.InputType)
+	if err := codec.Unmarshal(data, requestObject.Interface()); err != nil {
+		return reflect.Value{}, InvalidRequest
+	}
+	return requestObject.Elem(), nil
+}
+
+// callJSONProc calls a json proc by name with its raw json input, for
+// transports that carry several calls (batch, websocket). setup can adjust the
+// context before the call.
+func (app *Application) callJSONProc(request *http.Request, procName string, rawInput []byte, setup func(ctx *Context)) (any, error) {
+	proc, found := app.procMap[procName]
+	if !found {
+		return nil, ProcedureNotFound
+	}
+	if proc.InputType == httpRequestPtr || proc.Stream {
+		return nil, TransportNotSupported
+	}
+	if len(rawInput) > proc.MaxBytes {
+		return nil, InvalidRequest
+	}
+	input, err := decodeInput(&proc, JSONCodec, bytes.NewReader(rawInput))
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx = MakeContext(app, request)
+	defer CloseContext(&ctx)
+	if setup != nil {
+		setup(&ctx)
+	}
+	return app.runProc(&ctx, &proc, input)
+}
+
+// runProc enforces the proc's options and calls it through the interceptors
+func (app *Application) runProc(ctx *Context, proc *ProcedureInfo, args ...reflect.Value) (any, error) {
+	if err := app.checkRateLimits(ctx, proc); err != nil {
+		return nil, err
+	}
+	ctx.readOnly = proc.Options.ReadOnly
+	if proc.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx.Context, cancel = context.WithTimeout(ctx.Context, proc.Options.Timeout)
+		defer cancel()
+	}
+	if proc.Options.AuthRequired {
+		if err := app.checkAuth(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateValue(proc.validator, args[0]); err != nil {
+		return nil, err
+	}
+	// the client might be gone before we even start
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	var call = ProcCall{ProcName: proc.ProcName, Input: args[0].Interface(), IsStream: proc.Stream}
+	output, err := app.callProc(ctx, &call, proc.ProcValue, args...)
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		// the proc was cancelled or ran past its deadline; discard its result
+		// so the transaction is not committed and the client is told why
+		err = ctxErr
+	}
+	if err == nil && ctx.idempotent != nil {
+		err = app.storeResponse(ctx, output)
+	}
+	if err = finishTx(ctx, err); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// contextError maps the standard context errors to the errors we send to clients
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return RequestTimeout
+	default:
+		return RequestCancelled
+	}
+}
+
+func (app *Application) checkAuth(ctx *Context) error {
+	if app.AuthCheck != nil {
+		return app.AuthCheck(ctx)
+	}
+	if app.Sessions != nil {
+		if ctx.Session() == nil {
+			return NotAuthenticated
+		}
+		return nil
+	}
+	if ctx.Token == "" {
+		return NotAuthenticated
+	}
+	return nil
+}
+
 func (app *Application) HandleStatic(w http.ResponseWriter, request *http.Request) {
 	if request.Method != "GET" {
 		http.Error(w, "Only GET requests supported", 400)
@@ -307,6 +500,10 @@ func (app *Application) HandleStatic(w http.ResponseWriter, request *http.Reques
 	// cache for 24 hours
 	w.Header().Set("Cache-Control", "max-age=86400")
 
+	if servePrecompressed(app.StaticData, w, newRequest, strings.TrimPrefix(newPath, "/")) {
+		return
+	}
+
 	staticServer := http.FileServer(http.FS(app.StaticData))
 	staticServer.ServeHTTP(w, newRequest)
 }
@@ -314,10 +511,17 @@ func (app *Application) HandleStatic(w http.ResponseWriter, request *http.Reques
 func (app *Application) HandleData(w http.ResponseWriter, request *http.Request) {
 	// unlike the RPC, the data url requires a GET request, and results in
 	// some kind of file download
+	if app.handleCORS(w, request) {
+		return
+	}
 	if request.Method != "GET" {
 		http.Error(w, "Only GET requests supported", 400)
 		return
 	}
+	if err := app.checkCSRFOrigin(request); err != nil {
+		RespondError(w, err)
+		return
+	}
 	var procName = strings.TrimPrefix(request.RequestURI, PREFIX_DATA)
 	var proc, found = app.dataProcMap[procName]
 	if !found {
@@ -336,29 +540,26 @@ func (app *Application) HandleData(w http.ResponseWriter, request *http.Request)
 		}
 	*/
 
-	var output []reflect.Value
+	var input = requestObject.Elem()
+	var output any
+	var err error
 	procStart := time.Now()
 	func() { // Go version of a scoped defer
-		var context = MakeContext(app, request)
-		defer CloseContext(&context)
-
-		var args = []reflect.Value{
-			reflect.ValueOf(&context),
-			requestObject.Elem(),
-		}
-
-		output = proc.ProcValue.Call(args)
+		var ctx = MakeContext(app, request)
+		defer CloseContext(&ctx)
+		var call = ProcCall{ProcName: proc.ProcName, Input: input.Interface(), IsDataProc: true}
+		output, err = app.callProc(&ctx, &call, proc.ProcValue, input)
+		err = finishTx(&ctx, err)
 	}()
 
 	rw := w.(*ResponseWriter)
 	rw.procDur = time.Since(procStart)
 
 	// check if error was returned
-	if output[1].IsNil() {
-		content := output[0].Interface().(ContentDownload)
+	if err == nil {
+		content := output.(ContentDownload)
 		RespondContentDownload(rw, &content)
 	} else {
-		var err = output[1].Interface().(error)
 		RespondError(w, err)
 	}
 }
@@ -0,0 +1,72 @@
+package vbeam
+
+import (
+	"log"
+	"strings"
+)
+
+// ------------------------------------------
+// section: Transaction hooks
+// ------------------------------------------
+//
+// Side effects that must only happen once the proc's writes are committed
+// (sending an email, pushing a notification) go in AfterCommit:
+//
+//	UseWriteTx(ctx)
+//	saveOrder(ctx.Tx, order)
+//	ctx.AfterCommit(func() {
+//		sendConfirmation(order)
+//	})
+//
+// CloseContext runs the hooks after the transaction is closed, before the
+// response is sent; start a goroutine from the hook for slow work. A hook
+// that panics is logged with its stack trace and doesn't stop the others.
+
+// AfterCommit registers fn to run once the writes of the call are committed.
+// It's dropped if they are rolled back instead.
+func (ctx *Context) AfterCommit(fn func()) {
+	ctx.afterCommit = append(ctx.afterCommit, fn)
+}
+
+// AfterRollback registers fn to run if the writes of the call are rolled back,
+// because the proc returned an error or panicked
+func (ctx *Context) AfterRollback(fn func()) {
+	ctx.afterRollback = append(ctx.afterRollback, fn)
+}
+
+// hooksCommitted is called when ctx.Commit commits early: the hooks
+// registered so far have their outcome
+func (ctx *Context) hooksCommitted() {
+	ctx.committedHooks = append(ctx.committedHooks, ctx.afterCommit...)
+	ctx.afterCommit = nil
+	ctx.afterRollback = nil
+}
+
+// runTxHooks runs the hooks for the outcome of the call; calls that didn't
+// finish through finishTx (e.g. a hand made context) count as rolled back,
+// since CloseContext rolls back whatever is left
+func runTxHooks(ctx *Context) {
+	var hooks = ctx.committedHooks
+	if ctx.committed {
+		hooks = append(hooks, ctx.afterCommit...)
+	} else {
+		hooks = append(hooks, ctx.afterRollback...)
+	}
+	ctx.committedHooks, ctx.afterCommit, ctx.afterRollback = nil, nil, nil
+	for _, fn := range hooks {
+		runTxHook(ctx, fn)
+	}
+}
+
+func runTxHook(ctx *Context, fn func()) {
+	defer func() {
+		if crash := recover(); crash != nil {
+			var buf strings.Builder
+			warningRed.Fprint(&buf, "\n")
+			warningRed.Fprintf(&buf, "%s: transaction hook panicked: %v\n", ctx.procName, crash)
+			PrintUsefulStackTrace(&buf)
+			log.Print(buf.String())
+		}
+	}()
+	fn()
+}
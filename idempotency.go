@@ -0,0 +1,213 @@
+package vbeam
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+// ------------------------------------------
+// section: Idempotency keys
+// ------------------------------------------
+//
+// A client that doesn't know whether its call went through (e.g. it timed
+// out) can send it again with the same Idempotency-Key header, and the proc
+// won't run again:
+//
+//   - the first successful response for a key (per token and proc) is stored
+//     in the database for IdempotencyTTL and replayed for retries, with the
+//     Idempotent-Replayed header. It's written in the call's transaction, so
+//     it's stored exactly when the call's writes are committed.
+//   - a retry that arrives while the first call is still running gets
+//     IdempotencyConflict
+//   - reusing a key with a different request body, or asking for another
+//     encoding (Accept header), gets IdempotencyKeyReused
+//
+// Failed calls are not stored, so they can be retried with the same key.
+//
+// The header works with any rpc call except streams. For procs registered
+// with the Idempotent option, the generated TS client makes up a key for each
+// call and retries it on network errors.
+
+var IdempotencyConflict = errors.New("IdempotencyConflict")
+var IdempotencyKeyReused = errors.New("IdempotencyKeyReused")
+
+const IdempotencyHeader = "Idempotency-Key"
+
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+const MaxIdempotencyKeyLength = 255
+
+type storedResponse struct {
+	RequestHash string
+	ContentType string
+	Body        string
+	ExpiresAt   time.Time
+}
+
+func packStoredResponse(self *storedResponse, buf *vpack.Buffer) {
+	vpack.Version(1, buf)
+	vpack.String(&self.RequestHash, buf)
+	vpack.String(&self.ContentType, buf)
+	vpack.String(&self.Body, buf)
+	vpack.UnixTime(&self.ExpiresAt, buf)
+}
+
+// call id (hash of token, proc and key) => response
+var idempotencyBucket = vbolt.Bucket(&dbInfo, "vbeam_idempotency", vpack.StringZ, packStoredResponse)
+
+type idempotencyState struct {
+	mu        sync.Mutex
+	inFlight  map[string]bool
+	lastPurge time.Time
+}
+
+// idempotentCall is a call with a key, reserved until released
+type idempotentCall struct {
+	id          string
+	requestHash string
+	codec       Codec // for the response
+
+	// the response, encoded when it's stored
+	contentType string
+	body        []byte
+}
+
+func hashHex(parts ...string) string {
+	var h = sha256.New()
+	for _, part := range parts {
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// startIdempotentCall replays the stored response for a call with the same
+// key and returns done, or reserves the key; the caller must then release it.
+// Returns nil, false for calls without a key.
+func (app *Application) startIdempotentCall(w http.ResponseWriter, request *http.Request, procName string) (call *idempotentCall, done bool) {
+	var key = request.Header.Get(IdempotencyHeader)
+	if key == "" || app.DB == nil {
+		return nil, false
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		RespondError(w, InvalidRequest)
+		return nil, true
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		RespondError(w, InvalidRequest)
+		return nil, true
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var codec = app.responseCodec(request)
+	call = &idempotentCall{
+		id:          hashHex(requestToken(request), procName, key),
+		requestHash: hashHex(codec.ContentType(), string(body)),
+		codec:       codec,
+	}
+
+	app.idempotency.mu.Lock()
+	if app.idempotency.inFlight[call.id] {
+		app.idempotency.mu.Unlock()
+		RespondError(w, IdempotencyConflict)
+		return nil, true
+	}
+	if app.idempotency.inFlight == nil {
+		app.idempotency.inFlight = make(map[string]bool)
+	}
+	app.idempotency.inFlight[call.id] = true
+	app.idempotency.mu.Unlock()
+
+	var stored = app.loadStoredResponse(call.id)
+	if stored == nil {
+		return call, false
+	}
+	app.releaseIdempotentCall(call)
+	if stored.RequestHash != call.requestHash {
+		RespondError(w, IdempotencyKeyReused)
+		return nil, true
+	}
+	header := w.Header()
+	header.Set("Content-Type", stored.ContentType)
+	header.Set("Idempotent-Replayed", "true")
+	io.WriteString(w, stored.Body)
+	return nil, true
+}
+
+func (app *Application) releaseIdempotentCall(call *idempotentCall) {
+	app.idempotency.mu.Lock()
+	delete(app.idempotency.inFlight, call.id)
+	app.idempotency.mu.Unlock()
+}
+
+func (app *Application) loadStoredResponse(id string) *storedResponse {
+	var tx = vbolt.ReadTx(app.DB)
+	defer vbolt.TxClose(tx)
+	var stored storedResponse
+	if !vbolt.Read(tx, idempotencyBucket, id, &stored) || time.Now().After(stored.ExpiresAt) {
+		return nil
+	}
+	return &stored
+}
+
+// storeResponse encodes the output of a successful call with a key and writes
+// it in the call's transaction, before it's committed
+func (app *Application) storeResponse(ctx *Context, output any) error {
+	var call = ctx.idempotent
+	contentType, body, err := encodeOutput(call.codec, output)
+	if err != nil {
+		log.Printf("could not encode output of type %T: %v", output, err)
+		return InternalServerError
+	}
+	call.contentType, call.body = contentType, body
+
+	var ttl = app.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	var now = time.Now()
+	var stored = storedResponse{
+		RequestHash: call.requestHash,
+		ContentType: contentType,
+		Body:        string(body),
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	useWriteTxAfterProc(ctx)
+	vbolt.Write(ctx.Tx, idempotencyBucket, call.id, &stored)
+	app.purgeStoredResponses(ctx.Tx, now)
+	return nil
+}
+
+// purgeStoredResponses deletes expired responses, at most once an hour
+func (app *Application) purgeStoredResponses(tx *vbolt.Tx, now time.Time) {
+	app.idempotency.mu.Lock()
+	if now.Sub(app.idempotency.lastPurge) < time.Hour {
+		app.idempotency.mu.Unlock()
+		return
+	}
+	app.idempotency.lastPurge = now
+	app.idempotency.mu.Unlock()
+
+	var expired []string
+	vbolt.IterateAll(tx, idempotencyBucket, func(id string, stored storedResponse) bool {
+		if now.After(stored.ExpiresAt) {
+			expired = append(expired, id)
+		}
+		return true
+	})
+	for _, id := range expired {
+		vbolt.Delete(tx, idempotencyBucket, id)
+	}
+}
@@ -0,0 +1,179 @@
+package vbeam
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+// ------------------------------------------
+// section: Incidents
+// ------------------------------------------
+//
+// A panic inside a procedure (or one of its interceptors) is recovered right
+// there: the transaction is rolled back, the stack trace is logged and kept
+// under a random incident id, and the client gets an InternalServerError that
+// carries the id, so a bug report can be matched to its stack trace.
+//
+// Incidents are kept in the app's database (when it has one), so they can be
+// looked up after a restart.
+
+type Incident struct {
+	Id       string
+	Time     time.Time
+	ProcName string
+	Panic    string // the value passed to panic
+	Trace    []StackTraceElement
+}
+
+// how many recent incidents are kept in the database; older ones are deleted
+const MaxIncidents = 1000
+
+func packIncident(self *Incident, buf *vpack.Buffer) {
+	vpack.Version(1, buf)
+	vpack.String(&self.Id, buf)
+	vpack.UnixTime(&self.Time, buf)
+	vpack.String(&self.ProcName, buf)
+	vpack.String(&self.Panic, buf)
+	vpack.Slice(&self.Trace, packStackTraceElement, buf)
+}
+
+func packStackTraceElement(self *StackTraceElement, buf *vpack.Buffer) {
+	vpack.Version(1, buf)
+	vpack.String(&self.Package, buf)
+	vpack.String(&self.Function, buf)
+	vpack.String(&self.Filename, buf)
+	vpack.Int(&self.Line, buf)
+	vpack.Int(&self.Character, buf)
+	vpack.Slice(&self.SurroundingLines, packFileLine, buf)
+}
+
+func packFileLine(self *FileLine, buf *vpack.Buffer) {
+	vpack.Int(&self.Number, buf)
+	vpack.String(&self.Text, buf)
+}
+
+// incident id => incident
+var incidentsBucket = vbolt.Bucket(&dbInfo, "vbeam_incidents", vpack.StringZ, packIncident)
+
+// incident id => time; ids sort by time, so this lists the incidents from
+// oldest to newest without loading their stack traces
+var incidentTimesBucket = vbolt.Bucket(&dbInfo, "vbeam_incident_times", vpack.StringZ, vpack.UnixTime)
+
+// Incident looks up a recent incident by id
+func (app *Application) Incident(id string) (incident Incident, found bool) {
+	if app.DB == nil {
+		return
+	}
+	var tx = vbolt.ReadTx(app.DB)
+	defer vbolt.TxClose(tx)
+	found = vbolt.Read(tx, incidentsBucket, id, &incident)
+	return
+}
+
+// Incidents returns the recent incidents, newest first
+func (app *Application) Incidents() []Incident {
+	if app.DB == nil {
+		return nil
+	}
+	var tx = vbolt.ReadTx(app.DB)
+	defer vbolt.TxClose(tx)
+	var ids []string
+	vbolt.IterateAll(tx, incidentTimesBucket, func(id string, _ time.Time) bool {
+		ids = append(ids, id)
+		return true
+	})
+	var result = make([]Incident, 0, len(ids))
+	for index := len(ids) - 1; index >= 0; index-- {
+		var incident Incident
+		if vbolt.Read(tx, incidentsBucket, ids[index], &incident) {
+			result = append(result, incident)
+		}
+	}
+	return result
+}
+
+// incident ids start with the time in milliseconds, so they sort by time
+func newIncidentId(now time.Time) string {
+	var b [10]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixMilli())<<16)
+	rand.Read(b[6:])
+	return hex.EncodeToString(b[:])
+}
+
+// storeIncident saves the incident and deletes the oldest ones beyond
+// MaxIncidents. It runs on its own goroutine: the panicking proc may have been
+// called by another one that still holds the write transaction.
+func (app *Application) storeIncident(incident Incident) {
+	defer func() {
+		if crash := recover(); crash != nil {
+			log.Printf("could not store incident %s: %v", incident.Id, crash)
+		}
+	}()
+	var tx = vbolt.WriteTx(app.DB)
+	defer vbolt.TxClose(tx)
+	vbolt.Write(tx, incidentsBucket, incident.Id, &incident)
+	vbolt.Write(tx, incidentTimesBucket, incident.Id, &incident.Time)
+
+	var ids []string
+	vbolt.IterateAll(tx, incidentTimesBucket, func(id string, _ time.Time) bool {
+		ids = append(ids, id)
+		return true
+	})
+	for _, id := range ids[:max(len(ids)-MaxIncidents, 0)] {
+		vbolt.Delete(tx, incidentsBucket, id)
+		vbolt.Delete(tx, incidentTimesBucket, id)
+	}
+	vbolt.TxCommit(tx)
+}
+
+// recoverIncident must be called from a deferred function while panicking, so
+// that the stack trace points to the panic
+func (app *Application) recoverIncident(ctx *Context, procName string, crash any) error {
+	var now = time.Now()
+	var incident = Incident{
+		Id:       newIncidentId(now),
+		Time:     now,
+		ProcName: procName,
+		Panic:    fmt.Sprint(crash),
+		Trace:    UsefulStackTrace(),
+	}
+
+	// nothing the proc did can be trusted now
+	if ctx.Tx != nil {
+		vbolt.TxClose(ctx.Tx)
+		ctx.Tx = nil
+	}
+
+	var buf strings.Builder
+	warningRed.Fprint(&buf, "\n")
+	warningRed.Fprint(&buf, "=======================================\n")
+	warningRed.Fprint(&buf, "   ******* Procedure panicked! *******   \n")
+	warningRed.Fprint(&buf, "---------------------------------------\n")
+	warningRed.Fprintf(&buf, "%s incident: %s\n", procName, incident.Id)
+	warningRed.Fprint(&buf, "---------------------------------------\n")
+	warningRed.Fprintf(&buf, "%s\n", incident.Panic)
+	PrintStacktraceElements(&buf, incident.Trace)
+	warningRed.Fprint(&buf, "=======================================\n")
+	log.Print(buf.String())
+
+	if app.DB != nil {
+		go app.storeIncident(incident)
+	}
+
+	if app.OnIncident != nil {
+		app.OnIncident(incident)
+	}
+
+	var e = AsError(InternalServerError)
+	e.Message = "Internal server error (incident " + incident.Id + ")"
+	e.Details = map[string]string{"incident": incident.Id}
+	return e
+}
@@ -0,0 +1,93 @@
+package vbeam
+
+import (
+	"reflect"
+)
+
+// ProcCall describes a procedure invocation as seen by interceptors
+type ProcCall struct {
+	ProcName string
+
+	// The decoded input; for raw input procs, it's the *http.Request
+	Input any
+
+	// data procs return a ContentDownload instead of json
+	IsDataProc bool
+
+	// stream procs have no output; their items are sent through emit
+	IsStream bool
+
+	// background jobs have no output, and no client (see RegisterJob)
+	IsJob bool
+
+	// scheduled tasks have no input, no output and no client (see Schedule)
+	IsScheduled bool
+}
+
+// Interceptor wraps procedure calls, for cross-cutting concerns like auth
+// checks, audit logs and metrics.
+//
+// Call next to run the procedure (and the interceptors after this one). To
+// short-circuit the call, return an error without calling next.
+type Interceptor func(ctx *Context, call *ProcCall, next func() (any, error)) (any, error)
+
+// Intercept adds an interceptor that wraps every procedure call. Interceptors
+// run in the order they are added, and global interceptors run before per proc
+// interceptors.
+//
+// Background jobs and scheduled tasks don't go through these: they have no
+// client, so checks like auth would reject them. See InterceptJobs.
+func (app *Application) Intercept(fn Interceptor) {
+	app.interceptors = append(app.interceptors, fn)
+}
+
+// InterceptProc adds an interceptor that only wraps calls to the named proc
+func (app *Application) InterceptProc(procName string, fn Interceptor) {
+	app.procInterceptors[procName] = append(app.procInterceptors[procName], fn)
+}
+
+// InterceptJobs adds an interceptor that wraps every background job and
+// scheduled task, in the order they are added. The proc interceptors don't
+// apply to them, so an interceptor wanted for both has to be added with both
+// functions.
+func (app *Application) InterceptJobs(fn Interceptor) {
+	app.jobInterceptors = append(app.jobInterceptors, fn)
+}
+
+// callProc calls the proc through the interceptor chain. args are passed to
+// the proc after the context (the input, and the emit function for streams).
+// Panics are turned into an incident and an InternalServerError.
+func (app *Application) callProc(ctx *Context, call *ProcCall, procValue reflect.Value, args ...reflect.Value) (output any, err error) {
+	ctx.procName = call.ProcName
+	defer func() {
+		if crash := recover(); crash != nil {
+			output, err = nil, app.recoverIncident(ctx, call.ProcName, crash)
+		}
+	}()
+
+	var next = func() (any, error) {
+		var output = procValue.Call(append([]reflect.Value{reflect.ValueOf(ctx)}, args...))
+		// the error is always last; stream procs have no other output
+		var err, _ = output[len(output)-1].Interface().(error)
+		if len(output) == 1 {
+			return nil, err
+		}
+		return output[0].Interface(), err
+	}
+
+	var chain []Interceptor
+	if call.IsJob || call.IsScheduled {
+		chain = append(chain, app.jobInterceptors...)
+	} else {
+		chain = append(chain, app.interceptors...)
+		chain = append(chain, app.procInterceptors[call.ProcName]...)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		var fn = chain[i]
+		var inner = next
+		next = func() (any, error) {
+			return fn(ctx, call, inner)
+		}
+	}
+	return next()
+}
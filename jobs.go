@@ -0,0 +1,474 @@
+package vbeam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.hasen.dev/generic"
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+// ------------------------------------------
+// section: Background jobs
+// ------------------------------------------
+//
+// Deferred work (emails, reports, cleanups) that has to survive restarts.
+// Procs enqueue jobs in their write transaction, so a job is queued if and
+// only if the proc's writes are committed:
+//
+//	func SendWelcomeEmail(ctx *vbeam.Context, userId int) error { ... }
+//
+//	vbeam.RegisterJob(app, SendWelcomeEmail, vbeam.JobOptions{MaxAttempts: 10})
+//	app.StartJobs(vbeam.JobWorkerOptions{Concurrency: 4})
+//
+//	// in a proc
+//	vbeam.Enqueue(ctx, SendWelcomeEmail, user.Id)
+//
+// Handlers get a Context like procs (without a token). They don't go through
+// the proc interceptors, which would e.g. fail auth checks, but through their
+// own chain (see InterceptJobs), with ProcCall.IsJob set. When a handler returns nil, its
+// writes are committed together with the removal of the job. A job that fails
+// (returns an error, panics or times out) is retried with exponential
+// backoff; after MaxAttempts it's moved to the dead jobs, where it can be
+// looked at and requeued.
+//
+// Jobs run at least once: a job cut short by a crash runs again on the next
+// start.
+
+type JobOptions struct {
+	// Runs before the job is given up on. Defaults to 5
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for each retry after that.
+	// Defaults to 10 seconds
+	Backoff time.Duration
+
+	// Longest delay between retries. Defaults to an hour
+	MaxBackoff time.Duration
+
+	// How many jobs of this kind can run at once. Zero means only the worker
+	// limit applies
+	Concurrency int
+
+	// Maximum run time. Zero means no limit
+	Timeout time.Duration
+}
+
+type JobWorkerOptions struct {
+	// How many jobs can run at once. Defaults to 4
+	Concurrency int
+
+	// How long StopJobs waits for running jobs before cancelling them.
+	// Defaults to 10 seconds
+	ShutdownTimeout time.Duration
+}
+
+// Job is a queued or dead job
+type Job struct {
+	Id        int
+	Name      string
+	Input     json.RawMessage
+	Attempts  int // failed runs so far
+	RunAt     time.Time
+	CreatedAt time.Time
+	LastError string `json:",omitempty"`
+
+	key string // the job's key in the queue
+}
+
+var JobNotFound = errors.New("JobNotFound")
+
+func packJob(self *Job, buf *vpack.Buffer) {
+	vpack.Version(1, buf)
+	vpack.Int(&self.Id, buf)
+	vpack.String(&self.Name, buf)
+	var input = string(self.Input)
+	vpack.String(&input, buf)
+	self.Input = json.RawMessage(input)
+	vpack.Int(&self.Attempts, buf)
+	vpack.UnixTime(&self.RunAt, buf)
+	vpack.UnixTime(&self.CreatedAt, buf)
+	vpack.String(&self.LastError, buf)
+}
+
+// jobKey(run time, id) -> Job, so that iterating visits the jobs in the order
+// they are due
+var jobsBucket = vbolt.Bucket(&dbInfo, "vbeam_jobs", vpack.StringZ, packJob)
+
+// id -> Job
+var deadJobsBucket = vbolt.Bucket(&dbInfo, "vbeam_dead_jobs", vpack.FInt, packJob)
+
+type jobKind struct {
+	name      string
+	handler   reflect.Value
+	inputType reflect.Type
+	options   JobOptions
+	running   int
+}
+
+type jobRunner struct {
+	mu       sync.Mutex
+	kinds    map[string]*jobKind
+	running  map[int]bool
+	options  JobWorkerOptions
+	started  bool
+	stopping bool
+
+	wake     chan struct{}
+	stop     chan struct{} // closed to stop the dispatcher
+	loopDone chan struct{}
+	jobsDone sync.WaitGroup
+
+	// parent of the running jobs' contexts; cancelled when shutting down
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// RegisterJob registers a job handler. Like procs, jobs are named after their
+// function. Register all jobs before calling StartJobs.
+func RegisterJob[Input any](app *Application, handler func(ctx *Context, input Input) error, options JobOptions) {
+	var handlerValue = reflect.ValueOf(handler)
+	var name = _LocalProcName(handlerValue)
+	var inputType = reflect.TypeOf((*Input)(nil)).Elem()
+	if reason := unsupportedJSONType(inputType, nil); reason != "" {
+		panic(fmt.Sprintf("cannot register job %s: input type %v: %s", name, inputType, reason))
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 5
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = 10 * time.Second
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = time.Hour
+	}
+
+	app.jobs.mu.Lock()
+	defer app.jobs.mu.Unlock()
+	if app.jobs.kinds == nil {
+		app.jobs.kinds = make(map[string]*jobKind)
+	}
+	app.jobs.kinds[name] = &jobKind{
+		name:      name,
+		handler:   handlerValue,
+		inputType: inputType,
+		options:   options,
+	}
+}
+
+// Enqueue queues a job in the context's write transaction
+func Enqueue[Input any](ctx *Context, handler func(ctx *Context, input Input) error, input Input) error {
+	return EnqueueAt(ctx, handler, input, time.Now())
+}
+
+// EnqueueAt queues a job that should not run before runAt
+func EnqueueAt[Input any](ctx *Context, handler func(ctx *Context, input Input) error, input Input, runAt time.Time) error {
+	var name = _LocalProcName(reflect.ValueOf(handler))
+	if ctx.app == nil || ctx.app.jobs.kind(name) == nil {
+		panic(fmt.Sprintf("job %s is not registered", name))
+	}
+	if ctx.Tx == nil {
+		panic("jobs need a database")
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	UseWriteTx(ctx)
+	var job = Job{Id: vbolt.NextIntId(ctx.Tx, jobsBucket), Name: name, Input: data, RunAt: runAt, CreatedAt: time.Now()}
+	putJob(ctx.Tx, &job)
+	ctx.AfterCommit(ctx.app.jobs.notify)
+	return nil
+}
+
+func (r *jobRunner) kind(name string) *jobKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.kinds[name]
+}
+
+// notify wakes up the dispatcher, if it's running
+func (r *jobRunner) notify() {
+	r.mu.Lock()
+	var wake = r.wake
+	r.mu.Unlock()
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// jobKey is the run time in unix nanoseconds followed by the id, zero padded
+// so that the keys sort by time. The stored RunAt only keeps seconds, so the
+// key is what tells exactly when a job is due.
+func jobKey(runAt time.Time, id int) string {
+	return fmt.Sprintf("%020d-%020d", runAt.UnixNano(), id)
+}
+
+func jobKeyTime(key string) time.Time {
+	nanos, _ := strconv.ParseInt(key[:min(len(key), 20)], 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// putJob queues the job at its RunAt
+func putJob(tx *vbolt.Tx, job *Job) {
+	job.key = jobKey(job.RunAt, job.Id)
+	vbolt.Write(tx, jobsBucket, job.key, job)
+}
+
+// StartJobs runs queued jobs in the background until StopJobs is called, or
+// the program exits through generic.ExitWithCleanup (e.g. when the back server
+// is told to terminate)
+func (app *Application) StartJobs(options JobWorkerOptions) {
+	if app.DB == nil {
+		panic("jobs need a database")
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 4
+	}
+	if options.ShutdownTimeout <= 0 {
+		options.ShutdownTimeout = 10 * time.Second
+	}
+
+	var r = &app.jobs
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return
+	}
+	r.started = true
+	r.options = options
+	r.running = make(map[int]bool)
+	r.wake = make(chan struct{}, 1)
+	r.stop = make(chan struct{})
+	r.loopDone = make(chan struct{})
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.mu.Unlock()
+
+	generic.AddExitCleanup(app.StopJobs)
+	go app.dispatchJobs()
+}
+
+// StopJobs stops picking up jobs and waits for the running ones, up to
+// ShutdownTimeout, then cancels their contexts. Jobs cut short are left in the
+// queue, without counting it as a failed attempt.
+func (app *Application) StopJobs() {
+	var r = &app.jobs
+	r.mu.Lock()
+	if !r.started || r.stopping {
+		r.mu.Unlock()
+		return
+	}
+	r.stopping = true
+	r.mu.Unlock()
+
+	close(r.stop)
+	<-r.loopDone
+
+	var finished = make(chan struct{})
+	go func() {
+		r.jobsDone.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(r.options.ShutdownTimeout):
+		log.Println("jobs: cancelling the jobs still running")
+		r.cancel()
+		// give them a moment to notice
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+		}
+	}
+	r.cancel()
+}
+
+func (app *Application) dispatchJobs() {
+	var r = &app.jobs
+	defer close(r.loopDone)
+	for {
+		var next = app.startDueJobs()
+		var timer = time.NewTimer(min(time.Until(next), time.Minute))
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-r.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// startDueJobs starts the jobs that are due, as far as the concurrency limits
+// allow, and returns when to look again. Finished jobs wake the dispatcher, so
+// jobs held back by the limits are picked up as soon as possible.
+func (app *Application) startDueJobs() (next time.Time) {
+	var r = &app.jobs
+	var now = time.Now()
+	next = now.Add(time.Minute)
+
+	var due []Job
+	var unknown []Job
+	var tx = vbolt.ReadTx(app.DB)
+	r.mu.Lock()
+	vbolt.IterateAll(tx, jobsBucket, func(key string, job Job) bool {
+		if len(r.running) >= r.options.Concurrency {
+			return false
+		}
+		if runAt := jobKeyTime(key); runAt.After(now) {
+			next = runAt
+			return false
+		}
+		if r.running[job.Id] {
+			return true
+		}
+		job.key = key
+		var kind = r.kinds[job.Name]
+		if kind == nil {
+			unknown = append(unknown, job)
+			return true
+		}
+		if kind.options.Concurrency > 0 && kind.running >= kind.options.Concurrency {
+			return true
+		}
+		kind.running++
+		r.running[job.Id] = true
+		due = append(due, job)
+		return true
+	})
+	r.mu.Unlock()
+	vbolt.TxClose(tx)
+
+	for index := range unknown {
+		app.failJob(&unknown[index], nil, errors.New("no handler registered"))
+	}
+	for _, job := range due {
+		r.jobsDone.Add(1)
+		go app.runJob(job)
+	}
+	return next
+}
+
+func (app *Application) runJob(job Job) {
+	var r = &app.jobs
+	defer r.jobsDone.Done()
+	var kind = r.kind(job.Name)
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, job.Id)
+		kind.running--
+		r.mu.Unlock()
+		r.notify()
+	}()
+
+	var parent context.Context
+	var cancel context.CancelFunc
+	if kind.options.Timeout > 0 {
+		parent, cancel = context.WithTimeout(r.ctx, kind.options.Timeout)
+	} else {
+		parent, cancel = context.WithCancel(r.ctx)
+	}
+	defer cancel()
+
+	var ctx = newContext(app, parent, "")
+	var err = app.callJob(&ctx, kind, &job)
+	CloseContext(&ctx)
+	if err == nil {
+		return
+	}
+
+	r.mu.Lock()
+	var stopping = r.stopping
+	r.mu.Unlock()
+	if stopping && errors.Is(err, RequestCancelled) {
+		return // runs again on the next start
+	}
+	app.failJob(&job, kind, err)
+}
+
+// callJob runs the handler and removes the job in the handler's transaction,
+// so that its writes and the removal are committed together
+func (app *Application) callJob(ctx *Context, kind *jobKind, job *Job) error {
+	var input = reflect.New(kind.inputType)
+	if err := json.Unmarshal(job.Input, input.Interface()); err != nil {
+		return err
+	}
+	var call = ProcCall{ProcName: job.Name, Input: input.Elem().Interface(), IsJob: true}
+	_, err := app.callProc(ctx, &call, kind.handler, input.Elem())
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		err = ctxErr
+	}
+	if err == nil {
+		useWriteTxAfterProc(ctx)
+		vbolt.Delete(ctx.Tx, jobsBucket, job.key)
+	}
+	return finishTx(ctx, err)
+}
+
+// failJob reschedules a failed job with backoff, or moves it to the dead jobs
+// after its last attempt (or right away when its kind is unknown)
+func (app *Application) failJob(job *Job, kind *jobKind, failure error) {
+	var tx = vbolt.WriteTx(app.DB)
+	defer vbolt.TxClose(tx)
+	vbolt.Delete(tx, jobsBucket, job.key)
+	job.Attempts++
+	job.LastError = failure.Error()
+	if kind == nil || job.Attempts >= kind.options.MaxAttempts {
+		log.Printf("job %s (%d) failed, giving up after %d attempts: %v", job.Name, job.Id, job.Attempts, failure)
+		vbolt.Write(tx, deadJobsBucket, job.Id, job)
+	} else {
+		var delay = kind.options.Backoff
+		for i := 1; i < job.Attempts && delay < kind.options.MaxBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, kind.options.MaxBackoff)
+		log.Printf("job %s (%d) failed, retrying in %v: %v", job.Name, job.Id, delay, failure)
+		job.RunAt = time.Now().Add(delay)
+		putJob(tx, job)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("jobs: could not reschedule job:", err)
+	}
+}
+
+// DeadJobs returns the jobs that were given up on, oldest first
+func (app *Application) DeadJobs() []Job {
+	var jobs []Job
+	var tx = vbolt.ReadTx(app.DB)
+	defer vbolt.TxClose(tx)
+	vbolt.IterateAll(tx, deadJobsBucket, func(id int, job Job) bool {
+		jobs = append(jobs, job)
+		return true
+	})
+	return jobs
+}
+
+// RequeueDeadJob puts a dead job back in the queue, to run right away with a
+// fresh set of attempts
+func (app *Application) RequeueDeadJob(id int) error {
+	var tx = vbolt.WriteTx(app.DB)
+	defer vbolt.TxClose(tx)
+	var job Job
+	if !vbolt.Read(tx, deadJobsBucket, id, &job) {
+		return JobNotFound
+	}
+	job.Attempts = 0
+	job.RunAt = time.Now()
+	vbolt.Delete(tx, deadJobsBucket, id)
+	putJob(tx, &job)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	app.jobs.notify()
+	return nil
+}
@@ -1,15 +1,21 @@
 package vbeam
 
 import (
+	"context"
+	_ "embed"
+	"encoding"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 
 	"go.hasen.dev/vbeam/tsbridge"
 
@@ -25,6 +31,43 @@ type Context struct {
 	AppName string // because same proc can be used by multiple applications
 	Token   string
 	*vbolt.Tx
+
+	// Derived from the http request; it's cancelled when the client goes away
+	// or the proc's timeout (if any) expires. Long running procs should check
+	// ctx.Err() or select on ctx.Done() and stop early.
+	context.Context
+
+	// set for procs registered with ReadOnly
+	readOnly bool
+
+	// empty for in-process calls
+	clientIP string
+
+	// set for stream procs, which can't set cookies; see SetCookie
+	stream bool
+
+	// the token came from the authToken cookie rather than the x-auth-token
+	// header; see TokenFromCookie
+	tokenFromCookie bool
+
+	// set by Call; there's no client behind the call, and it may be nested in
+	// another call that holds the write transaction
+	inProcess bool
+
+	app           *Application
+	procName      string
+	session       *Session // see Session()
+	sessionLoaded bool
+	cookies       []*http.Cookie
+
+	// see AfterCommit
+	afterCommit    []func()
+	afterRollback  []func()
+	committedHooks []func() // committed early by ctx.Commit
+	committed      bool     // set by finishTx
+
+	// set for http calls with an Idempotency-Key
+	idempotent *idempotentCall
 }
 
 type Application struct {
@@ -40,6 +83,61 @@ type Application struct {
 	procList []string // keys into the procmap // TODO why do we have this list?!
 
 	dataProcMap map[string]DataProcInfo
+
+	// AuthCheck is called before procs registered with AuthRequired. When nil,
+	// a valid session is required if there's a SessionStore, otherwise a
+	// non-empty token is all that's required.
+	AuthCheck func(ctx *Context) error
+
+	// Sessions, when set, gives procs access to the session behind the token
+	// through ctx.Session(); see the vbeam/session package
+	Sessions SessionStore
+
+	// SubscribeCheck, when set, decides whether a websocket client may
+	// subscribe to an event
+	SubscribeCheck func(ctx *Context, event string) error
+
+	ws wsHub
+
+	interceptors     []Interceptor
+	procInterceptors map[string][]Interceptor
+	jobInterceptors  []Interceptor
+
+	// wire formats available besides json
+	codecs []Codec
+
+	// nil unless EnableCompression is called
+	compression *CompressionOptions
+
+	// OnIncident, when set, is called after a procedure panics, e.g. to store
+	// the incident somewhere permanent or to notify someone
+	OnIncident func(incident Incident)
+
+	// global limits; see RateLimit
+	rateLimiters []*rateLimiter
+
+	// checks for calls authenticated by the authToken cookie; see csrf.go
+	CSRF CSRFOptions
+
+	// nil unless EnableCORS is called
+	cors *CORSOptions
+
+	// Maximum size of the body of a batch call (all its calls together).
+	// Defaults to DefaultMaxBytes; each call is also held to its proc's
+	// MaxBytes
+	MaxBatchBytes int
+
+	// How long responses to calls with an Idempotency-Key are kept. Defaults
+	// to DefaultIdempotencyTTL
+	IdempotencyTTL time.Duration
+
+	idempotency idempotencyState
+
+	// see RegisterJob and StartJobs
+	jobs jobRunner
+
+	// see Schedule
+	schedules scheduler
 }
 
 type Empty struct{}
@@ -65,13 +163,27 @@ func getCookieValue(req *http.Request, name string) (value string) {
 	return
 }
 
-func MakeContext(app *Application, req *http.Request) (ctx Context) {
-	ctx.AppName = app.Name
-	ctx.Token = req.Header.Get("x-auth-token")
+func requestToken(req *http.Request) string {
+	var token = req.Header.Get("x-auth-token")
 	// if no header, try cookies
-	if ctx.Token == "" {
-		ctx.Token = getCookieValue(req, "authToken")
+	if token == "" {
+		token = getCookieValue(req, "authToken")
 	}
+	return token
+}
+
+func MakeContext(app *Application, req *http.Request) (ctx Context) {
+	ctx = newContext(app, req.Context(), requestToken(req))
+	ctx.clientIP = clientIP(req)
+	ctx.tokenFromCookie = usesAuthCookie(req)
+	return ctx
+}
+
+func newContext(app *Application, parent context.Context, token string) (ctx Context) {
+	ctx.AppName = app.Name
+	ctx.app = app
+	ctx.Context = parent
+	ctx.Token = token
 	if app.DB != nil {
 		ctx.Tx = vbolt.ReadTx(app.DB)
 	}
@@ -79,9 +191,21 @@ func MakeContext(app *Application, req *http.Request) (ctx Context) {
 }
 
 func CloseContext(ctx *Context) {
-	vbolt.TxClose(ctx.Tx)
+	if ctx.Tx != nil { // already released after a panic
+		vbolt.TxClose(ctx.Tx)
+		ctx.Tx = nil
+	}
+	runTxHooks(ctx)
+	// a nested call would wait forever on the write transaction of the call
+	// around it; the client's own call extends the session
+	if ctx.session != nil && !ctx.inProcess && ctx.app != nil && ctx.app.Sessions != nil {
+		ctx.app.Sessions.TouchSession(ctx.session)
+	}
 }
 
+// UseWriteTx switches the context to a write transaction. Its writes are
+// committed when the proc returns a nil error, and rolled back when it returns
+// an error or panics.
 func UseWriteTx(ctx *Context) {
 	if ctx.Tx == nil {
 		return
@@ -89,23 +213,91 @@ func UseWriteTx(ctx *Context) {
 	if ctx.Tx.Writable() {
 		return
 	}
+	if ctx.readOnly {
+		panic("UseWriteTx called from a read-only procedure")
+	}
 	db := ctx.Tx.DB()
 	vbolt.TxClose(ctx.Tx)
 	ctx.Tx = vbolt.WriteTx(db)
 }
 
+// Commit commits the writes made so far, for procs that need them to stay
+// even if the proc fails later. The context continues with a new read
+// transaction; call UseWriteTx again to write more.
+func (ctx *Context) Commit() error {
+	if ctx.Tx == nil || ctx.Tx.DB() == nil || !ctx.Tx.Writable() {
+		return nil
+	}
+	db := ctx.Tx.DB()
+	err := ctx.Tx.Commit()
+	if err == nil {
+		ctx.hooksCommitted()
+	}
+	ctx.Tx = vbolt.ReadTx(db)
+	return err
+}
+
+// finishTx commits the writes of a proc that returned a nil error and rolls
+// back those of one that failed. Panics are rolled back by recoverIncident.
+func finishTx(ctx *Context, err error) error {
+	// procs used to commit on their own; their tx is closed already
+	if ctx.Tx == nil || ctx.Tx.DB() == nil || !ctx.Tx.Writable() {
+		ctx.committed = err == nil
+		return err
+	}
+	if err != nil {
+		vbolt.TxClose(ctx.Tx)
+		ctx.Tx = nil
+		return err
+	}
+	var commitErr = ctx.Tx.Commit()
+	ctx.Tx = nil
+	if commitErr != nil {
+		log.Println("could not commit transaction:", commitErr)
+		return InternalServerError
+	}
+	ctx.committed = true
+	return nil
+}
+
+// useWriteTxAfterProc gets a write transaction for vbeam's own writes once a
+// proc (or job or task) has returned, so they are committed along with the
+// proc's writes by finishTx. The proc may have committed on its own, and a
+// read-only proc is done with its restriction by now.
+func useWriteTxAfterProc(ctx *Context) {
+	if ctx.Tx == nil || ctx.Tx.DB() == nil { // committed on its own
+		ctx.Tx = vbolt.WriteTx(ctx.app.DB)
+		return
+	}
+	if !ctx.Tx.Writable() {
+		var db = ctx.Tx.DB()
+		vbolt.TxClose(ctx.Tx)
+		ctx.Tx = vbolt.WriteTx(db)
+	}
+}
+
+// the buckets vbeam keeps in the app's database
+var dbInfo vbolt.Info
+
 // NewApplication creates a new Application instance
 func NewApplication(name string, db *vbolt.DB) *Application {
 	app := new(Application)
 	app.ServeMux = http.NewServeMux()
 	generic.InitMap(&app.procMap)
 	generic.InitMap(&app.dataProcMap)
+	generic.InitMap(&app.procInterceptors)
+	generic.InitMap(&app.ws.conns)
 
 	app.Name = name
 	app.DB = db
+	if db != nil {
+		vbolt.InitBuckets(db, &dbInfo)
+	}
+	app.RegisterCodec(MessagePackCodec)
 
 	app.HandleFunc(PREFIX_RPC, app.HandleRPC)
 	app.HandleFunc(PREFIX_DATA, app.HandleData)
+	app.HandleFunc(PATH_BATCH, app.HandleBatch)
 	app.HandleFunc(PREFIX_STATIC, app.HandleStatic)
 	app.HandleFunc("/", app.HandleRoot)
 
@@ -126,8 +318,49 @@ type ProcedureInfo struct {
 
 	// for preventing malicious inputs
 	MaxBytes int
+
+	Options ProcOptions
+
+	// stream procs emit any number of outputs; OutputType is the item type
+	Stream bool
+
+	// from the validate tags on the input type; nil when there are none
+	validator *typeValidator
+
+	// from Options.RateLimits
+	rateLimiters []*rateLimiter
+}
+
+// ProcOptions are per-procedure policies, enforced by the server at call time
+type ProcOptions struct {
+	// Maximum size of the request body. Defaults to 1MB
+	MaxBytes int
+
+	// Maximum execution time. Zero means no limit
+	Timeout time.Duration
+
+	// Read-only procs may not call UseWriteTx
+	ReadOnly bool
+
+	// Reject calls that don't pass the application's AuthCheck
+	AuthRequired bool
+
+	// Deprecated procs are marked as such in the typescript bindings, and the
+	// server logs a warning when they are called
+	Deprecated  bool
+	Description string
+
+	// Limits on how often the proc can be called, on top of the global ones
+	RateLimits []RateLimit
+
+	// Idempotent procs get an Idempotency-Key from the generated TS client,
+	// which makes retrying them safe (see idempotency.go). Not for streams
+	Idempotent bool
 }
 
+// 1MB is big enough for any json text. Use a file upload for larger requests
+const DefaultMaxBytes = 1024 * 1024
+
 // data procs are called at the address bar and return downloadable content
 type DataProcInfo struct {
 	ProcValue reflect.Value
@@ -135,50 +368,177 @@ type DataProcInfo struct {
 	InputType reflect.Type
 }
 
+//go:embed rpc_client.ts
+var rpcClientScript string
+
+func writeProcJSDoc(p *ProcedureInfo, w io.Writer) {
+	if p.Options.Description == "" && !p.Options.Deprecated {
+		return
+	}
+	fmt.Fprintln(w, "/**")
+	if p.Options.Description != "" {
+		for _, line := range strings.Split(p.Options.Description, "\n") {
+			fmt.Fprintf(w, " * %s\n", line)
+		}
+	}
+	if p.Options.Deprecated {
+		fmt.Fprintln(w, " * @deprecated")
+	}
+	fmt.Fprintln(w, " */")
+}
+
 func WriteProcTSBinding(p *ProcedureInfo, w io.Writer) {
-	var inputTypeName = p.InputType.Name()
-	var outputTypeName = p.OutputType.Name()
-	if p.InputType == httpRequestPtr {
-		fmt.Fprintf(w, "export async function %s(data: BodyInit): Promise<rpc.Response<%s>> {\n", p.ProcName, outputTypeName)
-		fmt.Fprintf(w, "    return await rpc.call<%s>('%s', data);\n", outputTypeName, p.ProcName)
+	var s2t tsbridge.Bridge
+	writeProcTSBinding(&s2t, p, w)
+}
+
+// tsOutputTypeName is the type of what clients get from the proc; text
+// outputs are strings whatever their Go type
+func tsOutputTypeName(s2t *tsbridge.Bridge, p *ProcedureInfo) string {
+	if !p.Stream && isPlainTextType(p.OutputType) {
+		return "string"
+	}
+	return s2t.DecideTypescriptTypeName(p.OutputType)
+}
+
+func writeProcTSBinding(s2t *tsbridge.Bridge, p *ProcedureInfo, w io.Writer) {
+	var inputTypeName = "BodyInit"
+	if p.InputType != httpRequestPtr {
+		inputTypeName = s2t.DecideTypescriptTypeName(p.InputType)
+	}
+	var outputTypeName = tsOutputTypeName(s2t, p)
+	writeProcJSDoc(p, w)
+	if p.Stream {
+		fmt.Fprintf(w, "export function %s(data: %s): AsyncGenerator<%s> {\n", p.ProcName, inputTypeName, outputTypeName)
+		fmt.Fprintf(w, "    return rpc.stream<%s>('%s', JSON.stringify(data));\n", outputTypeName, p.ProcName)
+		fmt.Fprintf(w, "}\n\n")
+
+	} else if p.Options.Idempotent {
+		// callers retrying on their own pass the key of the first attempt
+		var body = "JSON.stringify(data)"
+		if p.InputType == httpRequestPtr {
+			body = "data"
+		}
+		fmt.Fprintf(w, "export async function %s(data: %s, idempotencyKey: string = rpc.newIdempotencyKey()): Promise<rpc.Response<%s, ErrorCode>> {\n", p.ProcName, inputTypeName, outputTypeName)
+		fmt.Fprintf(w, "    return await rpc.call<%s, ErrorCode>('%s', %s, idempotencyKey);\n", outputTypeName, p.ProcName, body)
+		fmt.Fprintf(w, "}\n\n")
+
+	} else if p.InputType == httpRequestPtr {
+		fmt.Fprintf(w, "export async function %s(data: BodyInit): Promise<rpc.Response<%s, ErrorCode>> {\n", p.ProcName, outputTypeName)
+		fmt.Fprintf(w, "    return await rpc.call<%s, ErrorCode>('%s', data);\n", outputTypeName, p.ProcName)
 		fmt.Fprintf(w, "}\n\n")
 
 	} else {
-		fmt.Fprintf(w, "export async function %s(data: %s): Promise<rpc.Response<%s>> {\n", p.ProcName, inputTypeName, outputTypeName)
-		fmt.Fprintf(w, "    return await rpc.call<%s>('%s', JSON.stringify(data));\n", outputTypeName, p.ProcName)
+		fmt.Fprintf(w, "export async function %s(data: %s): Promise<rpc.Response<%s, ErrorCode>> {\n", p.ProcName, inputTypeName, outputTypeName)
+		fmt.Fprintf(w, "    return await rpc.call<%s, ErrorCode>('%s', JSON.stringify(data));\n", outputTypeName, p.ProcName)
 		fmt.Fprintf(w, "}\n\n")
 	}
 }
 
+// the client runtime is written next to the bindings, which import it
+const TSRuntimeFile = "vbeam_rpc.ts"
+
+// GenerateTSBindings writes the types and procs of the application to
+// targetFile, and the client runtime they use to TSRuntimeFile in the same
+// directory
 func GenerateTSBindings(app *Application, targetFile string) {
 	if targetFile == "" {
 		fmt.Println("WARNING: targetFile not specified for", app.Name)
 		return
 	}
 
+	WriteTSRuntime(filepath.Join(filepath.Dir(targetFile), TSRuntimeFile))
+
 	log.Println("Writing RPC bindings:", targetFile)
 	var f, err = os.OpenFile(targetFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
-	fmt.Fprintf(f, `import * as rpc from "vlens/rpc"`)
+	fmt.Fprintf(f, `import * as rpc from "./%s"`, strings.TrimSuffix(TSRuntimeFile, ".ts"))
 	fmt.Fprintln(f)
 	fmt.Fprintln(f)
 	var s2t tsbridge.Bridge
+	s2t.Runtime = "rpc"
+	// collect error vars from the packages defining procs; our own errors
+	// are in the runtime's BuiltinErrorCode
 	for _, procName := range app.procList {
 		proc := app.procMap[procName]
+		// deciding the names queues the types behind them (including the
+		// element types of slices, maps, etc)
 		if proc.InputType != httpRequestPtr {
-			s2t.QueueType(proc.InputType)
+			s2t.DecideTypescriptTypeName(proc.InputType)
 		}
-		s2t.QueueType(proc.OutputType)
+		s2t.DecideTypescriptTypeName(proc.OutputType)
+		s2t.QueuePackage(_ProcPackage(proc.ProcValue))
 	}
 	s2t.Process()
 	tsbridge.WriteStructTSBinding(&s2t, f)
 	for _, name := range app.procList {
 		proc := app.procMap[name]
-		WriteProcTSBinding(&proc, f)
+		writeProcTSBinding(&s2t, &proc, f)
+	}
+	writeProcTypesTSBinding(&s2t, app, f)
+	writeTypedHelpersTSBinding(f)
+}
+
+// WriteTSRuntime writes the client runtime module, with the codes of vbeam's
+// own errors. A file at targetFile that was not written by vbeam is left
+// alone.
+func WriteTSRuntime(targetFile string) {
+	if existing, err := os.ReadFile(targetFile); err == nil && !isGeneratedTSRuntime(existing) {
+		log.Println("WARNING: not overwriting", targetFile, "which was not generated by vbeam")
+		return
+	}
+	log.Println("Writing RPC client runtime:", targetFile)
+	var f, err = os.OpenFile(targetFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	io.WriteString(f, rpcClientScript)
+	fmt.Fprint(f, "\n// codes of the errors from vbeam itself, and the ones made up by the runtime\n")
+	fmt.Fprint(f, "export type BuiltinErrorCode =")
+	for _, err := range builtinErrors {
+		code, _ := json.Marshal(err.Error())
+		fmt.Fprintf(f, "\n    | %s", code)
+	}
+	fmt.Fprint(f, "\n    | \"ConnectionClosed\";\n")
+}
+
+// the runtime starts with a line marking it as generated
+func isGeneratedTSRuntime(content []byte) bool {
+	header, _, _ := strings.Cut(rpcClientScript, "\n")
+	return strings.HasPrefix(string(content), header)
+}
+
+// writeTypedHelpersTSBinding wraps the runtime helpers that take any proc, so
+// they are checked against ProcTypes
+func writeTypedHelpersTSBinding(w io.Writer) {
+	io.WriteString(w, `// batch calls several procs in one round trip; results are in the same order
+export function batch<const C extends readonly rpc.BatchCall<ProcTypes>[]>(...calls: C): Promise<rpc.BatchResults<ProcTypes, C, ErrorCode>> {
+    return rpc.batch<ProcTypes, C, ErrorCode>(...calls);
+}
+
+// callBinary calls a json proc using MessagePack instead of json
+export function callBinary<P extends keyof ProcTypes>(proc: P, data: ProcTypes[P][0]): Promise<rpc.Response<ProcTypes[P][1], ErrorCode>> {
+    return rpc.callBinary<ProcTypes[P][1], ErrorCode>(proc, data);
+}
+`)
+}
+
+// writeProcTypesTSBinding maps the name of each json proc to its input and
+// output types; used to type the batch helper
+func writeProcTypesTSBinding(s2t *tsbridge.Bridge, app *Application, w io.Writer) {
+	fmt.Fprintln(w, "export interface ProcTypes {")
+	for _, name := range app.procList {
+		proc := app.procMap[name]
+		if proc.InputType == httpRequestPtr || proc.Stream {
+			continue
+		}
+		fmt.Fprintf(w, "    %s: [%s, %s]\n", proc.ProcName, s2t.DecideTypescriptTypeName(proc.InputType), tsOutputTypeName(s2t, &proc))
 	}
+	fmt.Fprintf(w, "}\n\n")
 }
 
 func _LocalProcName(procValue reflect.Value) string {
@@ -188,7 +548,18 @@ func _LocalProcName(procValue reflect.Value) string {
 	return procName
 }
 
-func _RegisterProc(app *Application, proc any, maxBytes int) {
+// ProcName returns the name a proc function is registered (and called) under
+func ProcName(proc any) string {
+	return _LocalProcName(reflect.ValueOf(proc))
+}
+
+func _ProcPackage(procValue reflect.Value) string {
+	fullName := runtime.FuncForPC(procValue.Pointer()).Name()
+	pkgPath, _ := packageSplit(fullName)
+	return pkgPath
+}
+
+func _RegisterProc(app *Application, proc any, options ProcOptions) {
 	var procValue = reflect.ValueOf(proc)
 	var procType = procValue.Type()
 
@@ -196,24 +567,114 @@ func _RegisterProc(app *Application, proc any, maxBytes int) {
 
 	var inputType reflect.Type = procType.In(1)
 
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultMaxBytes
+	}
+
 	var procInfo = ProcedureInfo{
 		ProcValue:  procValue,
 		ProcName:   procName,
 		InputType:  inputType,
 		OutputType: procType.Out(0),
-		MaxBytes:   maxBytes,
+		MaxBytes:   options.MaxBytes,
+		Options:    options,
+	}
+	if inputType != httpRequestPtr {
+		procInfo.validator = compileValidator(inputType)
+	}
+	for _, limit := range options.RateLimits {
+		procInfo.rateLimiters = append(procInfo.rateLimiters, newRateLimiter(procName, limit))
+	}
+	if procType.NumIn() == 3 { // stream proc; the third param is the emit function
+		procInfo.Stream = true
+		procInfo.OutputType = procType.In(2).In(0)
+	}
+	// catch types json can't handle now, rather than when the proc is called
+	if inputType != httpRequestPtr {
+		if reason := unsupportedJSONType(inputType, nil); reason != "" {
+			panic(fmt.Sprintf("cannot register %s: input type %v: %s", procName, inputType, reason))
+		}
+	}
+	if reason := unsupportedJSONType(procInfo.OutputType, nil); reason != "" {
+		panic(fmt.Sprintf("cannot register %s: output type %v: %s", procName, procInfo.OutputType, reason))
 	}
 	app.procMap[procName] = procInfo
 	app.procList = append(app.procList, procName)
 }
 
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// unsupportedJSONType explains why values of type t can't be encoded as json,
+// or returns "" if they can. Interface types can only be checked at runtime.
+func unsupportedJSONType(t reflect.Type, seen map[reflect.Type]bool) string {
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		return ""
+	}
+	if seen[t] { // recursive type; already being checked
+		return ""
+	}
+	if seen == nil {
+		seen = make(map[reflect.Type]bool)
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return t.Kind().String() + " values can't be encoded"
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return unsupportedJSONType(t.Elem(), seen)
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !t.Key().Implements(textMarshalerType) {
+				return fmt.Sprintf("map key type %v must be a string, an integer or a TextMarshaler", t.Key())
+			}
+		}
+		return unsupportedJSONType(t.Elem(), seen)
+	case reflect.Struct:
+		for index := 0; index < t.NumField(); index++ {
+			var field = t.Field(index)
+			if !field.IsExported() && !field.Anonymous {
+				continue
+			}
+			if field.Tag.Get("json") == "-" {
+				continue
+			}
+			if reason := unsupportedJSONType(field.Type, seen); reason != "" {
+				return fmt.Sprintf("field %s: %s", field.Name, reason)
+			}
+		}
+	}
+	return ""
+}
+
 func RegisterProc[Input, Output any](app *Application, proc func(*Context, Input) (Output, error)) {
-	// 1MB is big enough for any json text. Use a file upload for larger requests
-	_RegisterProc(app, proc, 1024*1024)
+	_RegisterProc(app, proc, ProcOptions{})
+}
+
+func RegisterProcOpts[Input, Output any](app *Application, proc func(*Context, Input) (Output, error), options ProcOptions) {
+	_RegisterProc(app, proc, options)
 }
 
 func RegisterProcRawInput[Output any](app *Application, proc func(*Context, *http.Request) (Output, error), maxBytes int) {
-	_RegisterProc(app, proc, maxBytes)
+	_RegisterProc(app, proc, ProcOptions{MaxBytes: maxBytes})
+}
+
+func RegisterProcRawInputOpts[Output any](app *Application, proc func(*Context, *http.Request) (Output, error), options ProcOptions) {
+	_RegisterProc(app, proc, options)
+}
+
+// RegisterStreamProc registers a proc that sends its results to the client as
+// they are produced, by calling emit for each item
+func RegisterStreamProc[Input, Output any](app *Application, proc func(ctx *Context, input Input, emit func(Output) error) error) {
+	_RegisterProc(app, proc, ProcOptions{})
+}
+
+func RegisterStreamProcOpts[Input, Output any](app *Application, proc func(ctx *Context, input Input, emit func(Output) error) error, options ProcOptions) {
+	_RegisterProc(app, proc, options)
 }
 
 func RegisterDataProc[Input any](app *Application, proc func(*Context, Input) (ContentDownload, error)) {
@@ -0,0 +1,123 @@
+package vbeam
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+var testDBInfo vbolt.Info
+
+// name -> value
+var testItems = vbolt.Bucket(&testDBInfo, "test_items", vpack.StringZ, vpack.String)
+
+var errTestFailure = errors.New("TestFailure")
+
+type testWrite struct {
+	Name  string
+	Value string
+}
+
+func WriteItem(ctx *Context, input testWrite) (string, error) {
+	UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, testItems, input.Name, &input.Value)
+	return input.Value, nil
+}
+
+func WriteItemThenFail(ctx *Context, input testWrite) (string, error) {
+	UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, testItems, input.Name, &input.Value)
+	return "", errTestFailure
+}
+
+func WriteItemThenPanic(ctx *Context, input testWrite) (string, error) {
+	UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, testItems, input.Name, &input.Value)
+	panic("test panic")
+}
+
+// commits the first item, then fails while writing a second one
+func WriteItemCommitThenFail(ctx *Context, input testWrite) (string, error) {
+	UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, testItems, input.Name, &input.Value)
+	if err := ctx.Commit(); err != nil {
+		return "", err
+	}
+	UseWriteTx(ctx)
+	var second = input.Value + "-second"
+	vbolt.Write(ctx.Tx, testItems, input.Name+"-second", &second)
+	return "", errTestFailure
+}
+
+func newTestApp(t *testing.T) *Application {
+	t.Helper()
+	var db = vbolt.Open(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	vbolt.InitBuckets(db, &testDBInfo)
+	var app = NewApplication("test", db)
+	RegisterProc(app, WriteItem)
+	RegisterProc(app, WriteItemThenFail)
+	RegisterProc(app, WriteItemThenPanic)
+	RegisterProc(app, WriteItemCommitThenFail)
+	return app
+}
+
+func readTestItem(app *Application, name string) (value string, found bool) {
+	var tx = vbolt.ReadTx(app.DB)
+	defer vbolt.TxClose(tx)
+	found = vbolt.Read(tx, testItems, name, &value)
+	return
+}
+
+func TestProcCommitsOnNilError(t *testing.T) {
+	var app = newTestApp(t)
+	output, err := Call(app, "WriteItem", "", testWrite{"a", "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output != "1" {
+		t.Fatalf("unexpected output: %v", output)
+	}
+	if value, found := readTestItem(app, "a"); !found || value != "1" {
+		t.Fatalf("write was not committed: %q, %v", value, found)
+	}
+}
+
+func TestProcRollsBackOnError(t *testing.T) {
+	var app = newTestApp(t)
+	_, err := Call(app, "WriteItemThenFail", "", testWrite{"a", "1"})
+	if AsError(err).Code != "TestFailure" {
+		t.Fatalf("expected TestFailure, got %v", err)
+	}
+	if _, found := readTestItem(app, "a"); found {
+		t.Fatal("write of a failed proc was committed")
+	}
+}
+
+func TestProcRollsBackOnPanic(t *testing.T) {
+	var app = newTestApp(t)
+	_, err := Call(app, "WriteItemThenPanic", "", testWrite{"a", "1"})
+	if !errors.Is(err, InternalServerError) {
+		t.Fatalf("expected InternalServerError, got %v", err)
+	}
+	if _, found := readTestItem(app, "a"); found {
+		t.Fatal("write of a panicking proc was committed")
+	}
+}
+
+func TestProcEarlyCommitKeepsFirstWrite(t *testing.T) {
+	var app = newTestApp(t)
+	_, err := Call(app, "WriteItemCommitThenFail", "", testWrite{"a", "1"})
+	if AsError(err).Code != "TestFailure" {
+		t.Fatalf("expected TestFailure, got %v", err)
+	}
+	if value, found := readTestItem(app, "a"); !found || value != "1" {
+		t.Fatalf("write committed with ctx.Commit was lost: %q, %v", value, found)
+	}
+	if _, found := readTestItem(app, "a-second"); found {
+		t.Fatal("write after ctx.Commit was committed although the proc failed")
+	}
+}
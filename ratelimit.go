@@ -0,0 +1,285 @@
+package vbeam
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------
+// section: Rate limiting
+// ------------------------------------------
+//
+// Token bucket rate limits, applied to rpc calls (including batch and
+// websocket calls) before anything else. Global limits are added with
+// app.RateLimit and apply to all procs; per proc limits go in ProcOptions.
+//
+//	// at most 10 calls per second from each ip, bursts of up to 20
+//	app.RateLimit(vbeam.RateLimit{Requests: 10, Per: time.Second, Burst: 20, By: vbeam.ByIP})
+//
+//	// 5 login attempts per minute per ip
+//	vbeam.RegisterProcOpts(app, Login, vbeam.ProcOptions{
+//		RateLimits: []vbeam.RateLimit{{Requests: 5, Per: time.Minute, By: vbeam.ByIP}},
+//	})
+//
+// Calls over the limit fail with RateLimited (http 429) and a Retry-After.
+
+var RateLimited = errors.New("RateLimited")
+
+// RateLimitKey says what a limit counts calls by; combine with |
+type RateLimitKey int
+
+const (
+	// clients without a token are counted by ip. With a SessionStore, so are
+	// clients whose token has no session, so made up tokens don't get their
+	// own budgets.
+	ByToken RateLimitKey = 1 << iota
+	ByIP
+	// for global limits; each proc gets its own budget
+	ByProc
+)
+
+type RateLimit struct {
+	// Requests allowed every Per, on average
+	Requests int
+	Per      time.Duration
+
+	// How many requests can be made at once before the rate kicks in.
+	// Defaults to Requests
+	Burst int
+
+	// Defaults to ByIP
+	By RateLimitKey
+}
+
+// how many clients (keys) each limit tracks; past that, the ones that were
+// idle the longest are forgotten
+const MaxRateLimitClients = 100_000
+
+// RateLimitStats are counters for one rate limit, since the app started
+type RateLimitStats struct {
+	ProcName string // empty for global limits
+	Limit    RateLimit
+	Allowed  uint64
+	Limited  uint64
+	Clients  int // keys currently tracked
+}
+
+// RateLimit adds a limit applied to every rpc call
+func (app *Application) RateLimit(limit RateLimit) {
+	app.rateLimiters = append(app.rateLimiters, newRateLimiter("", limit))
+}
+
+// RateLimitStats returns the counters of all global and per proc limits
+func (app *Application) RateLimitStats() []RateLimitStats {
+	var stats []RateLimitStats
+	for _, limiter := range app.rateLimiters {
+		stats = append(stats, limiter.stats())
+	}
+	for _, name := range app.procList {
+		for _, limiter := range app.procMap[name].rateLimiters {
+			stats = append(stats, limiter.stats())
+		}
+	}
+	return stats
+}
+
+func (app *Application) checkRateLimits(ctx *Context, proc *ProcedureInfo) error {
+	for _, limiters := range [][]*rateLimiter{app.rateLimiters, proc.rateLimiters} {
+		for _, limiter := range limiters {
+			if err := limiter.take(ctx, proc.ProcName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type rateLimiter struct {
+	procName string
+	limit    RateLimit
+	rate     float64 // tokens per second
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	allowed   uint64
+	limited   uint64
+}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // to only log the start of a run of rejections
+}
+
+func newRateLimiter(procName string, limit RateLimit) *rateLimiter {
+	if limit.Requests <= 0 || limit.Per <= 0 {
+		panic("rate limit needs positive Requests and Per")
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Requests
+	}
+	if limit.By == 0 {
+		limit.By = ByIP
+	}
+	return &rateLimiter{
+		procName:  procName,
+		limit:     limit,
+		rate:      float64(limit.Requests) / limit.Per.Seconds(),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *rateLimiter) key(ctx *Context, procName string) string {
+	var parts []string
+	if l.limit.By&ByToken != 0 {
+		if ctx.Token != "" && (ctx.app == nil || ctx.app.Sessions == nil || ctx.Session() != nil) {
+			parts = append(parts, "token:"+ctx.Token)
+		} else {
+			parts = append(parts, "ip:"+ctx.clientIP)
+		}
+	}
+	if l.limit.By&ByIP != 0 {
+		parts = append(parts, "ip:"+ctx.clientIP)
+	}
+	if l.limit.By&ByProc != 0 {
+		parts = append(parts, "proc:"+procName)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *rateLimiter) take(ctx *Context, procName string) error {
+	if ctx.clientIP == "" {
+		return nil // in-process call; there's no client to limit
+	}
+	var key = l.key(ctx, procName)
+	var now = time.Now()
+	var burst = float64(l.limit.Burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	var bucket = l.buckets[key]
+	if bucket == nil {
+		if len(l.buckets) >= MaxRateLimitClients {
+			l.evict(now)
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = false
+		l.allowed++
+		return nil
+	}
+
+	l.limited++
+	if !bucket.limited {
+		bucket.limited = true
+		log.Printf("rate limit exceeded: %s (limit %d per %v) by %s", l.name(), l.limit.Requests, l.limit.Per, key)
+	}
+	var wait = time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	var e = AsError(RateLimited)
+	e.RetryAfter = int(math.Ceil(wait.Seconds()))
+	return e
+}
+
+// sweep forgets buckets that have refilled completely; they are the same as
+// new buckets
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	var burst = float64(l.limit.Burst)
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// evict makes room for new clients: it forgets the buckets that have
+// refilled, and if that's not enough, the half that has been idle the longest
+func (l *rateLimiter) evict(now time.Time) {
+	l.lastSweep = time.Time{}
+	l.sweep(now)
+	if len(l.buckets) < MaxRateLimitClients*3/4 {
+		return
+	}
+	var lastSeen = make([]time.Time, 0, len(l.buckets))
+	for _, bucket := range l.buckets {
+		lastSeen = append(lastSeen, bucket.last)
+	}
+	sort.Slice(lastSeen, func(a, b int) bool { return lastSeen[a].Before(lastSeen[b]) })
+	var cutoff = lastSeen[len(lastSeen)/2]
+	for key, bucket := range l.buckets {
+		if !bucket.last.After(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+	log.Printf("rate limit %s: tracking too many clients; forgot the least recent", l.name())
+}
+
+func (l *rateLimiter) name() string {
+	if l.procName == "" {
+		return "global"
+	}
+	return l.procName
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimitStats{
+		ProcName: l.procName,
+		Limit:    l.limit,
+		Allowed:  l.allowed,
+		Limited:  l.limited,
+		Clients:  len(l.buckets),
+	}
+}
+
+// clientAddr is the address of the client, as reported by the connection or,
+// behind a local reverse proxy, by X-Forwarded-For
+func clientAddr(request *http.Request) string {
+	remoteAddr := request.RemoteAddr
+	if strings.HasPrefix(remoteAddr, "[::1]:") { // proxy!
+		remoteAddr = request.Header.Get("X-Forwarded-For")
+	}
+	return remoteAddr
+}
+
+// clientIP is the ip the request came from. Behind the local reverse proxy,
+// that's the last X-Forwarded-For entry, the one added by the proxy; entries
+// before it come from the client and can be anything.
+func clientIP(request *http.Request) string {
+	var addr = request.RemoteAddr
+	if strings.HasPrefix(addr, "[::1]:") { // proxy!
+		var forwarded = request.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			var last = forwarded[len(forwarded)-1]
+			last = strings.TrimSpace(last[strings.LastIndex(last, ",")+1:])
+			if last != "" {
+				addr = last
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,561 @@
+// ---- vbeam client runtime (generated, do not edit) ----
+// The generated bindings import this module as rpc. Apps can import it too,
+// for setBaseURL, connect, subscribe, validate, etc.
+
+export interface RPCError<Code extends string = string> {
+    code: Code
+    message: string
+    fields?: Record<string, string>
+    details?: any
+    retryAfter?: number // seconds, for RateLimited errors
+}
+
+export type Response<T, Code extends string = string> = [T, null] | [null, RPCError<Code>];
+
+export function decodeError<Code extends string = string>(text: string): RPCError<Code> {
+    try {
+        const e = JSON.parse(text);
+        if (e && typeof e.code === "string") {
+            return e as RPCError<Code>;
+        }
+    } catch {
+        // not an error envelope
+    }
+    return { code: text as Code, message: text };
+}
+
+// ---- api location ----
+// For frontends served from another origin than the api (see cors.go)
+
+let baseURL = "";
+let credentials: RequestCredentials = "same-origin";
+
+// setBaseURL makes calls go to the api at url, e.g. "https://api.example.com".
+// withCredentials sends cookies along; the server must allow it.
+export function setBaseURL(url: string, withCredentials: boolean = false) {
+    baseURL = url.replace(/\/+$/, "");
+    credentials = withCredentials ? "include" : "same-origin";
+}
+
+// ---- csrf ----
+// Calls authenticated by the authToken cookie must echo the csrfToken cookie
+// in the x-csrf-token header (see csrf.go).
+
+function csrfToken(): string {
+    if (typeof document === "undefined") {
+        return "";
+    }
+    const match = document.cookie.match(/(?:^|;\s*)csrfToken=([^;]*)/);
+    return match ? match[1] : "";
+}
+
+// post sends an rpc request with the csrf header. A call rejected for lacking
+// the token is sent once more, since the rejection hands out the cookie.
+// Calls with an idempotency key are also sent again after network errors.
+async function post(url: string, body: BodyInit, headers: Record<string, string> = {}, attempt: number = 0): ReturnType<typeof fetch> {
+    const token = csrfToken();
+    let response: Awaited<ReturnType<typeof fetch>>;
+    try {
+        response = await fetch(baseURL + url, {
+            method: "POST",
+            body,
+            credentials,
+            headers: token ? { ...headers, "x-csrf-token": token } : headers,
+        });
+    } catch (e) {
+        if (!headers["Idempotency-Key"] || attempt >= maxIdempotentRetries) {
+            throw e;
+        }
+        await new Promise(resolve => setTimeout(resolve, 500 * 2 ** attempt));
+        return post(url, body, headers, attempt + 1);
+    }
+    if (response.status === 403 && !token && csrfToken()) {
+        return post(url, body, headers, attempt);
+    }
+    return response;
+}
+
+// ---- idempotency keys ----
+// Procs registered as Idempotent take a key (one is made up per call by
+// default); the server replays the first response for retries with the same
+// key (see idempotency.go).
+
+const maxIdempotentRetries = 2;
+
+export function newIdempotencyKey(): string {
+    return crypto.randomUUID();
+}
+
+export async function call<T, Code extends string = string>(proc: string, data: BodyInit, idempotencyKey?: string): Promise<Response<T, Code>> {
+    if (!idempotencyKey && socket && socket.readyState === WebSocket.OPEN && typeof data === "string") {
+        return callOverSocket<T, Code>(proc, data);
+    }
+    const headers: Record<string, string> = idempotencyKey ? { "Idempotency-Key": idempotencyKey } : {};
+    const response = await post("/rpc/" + proc, data, headers);
+    const text = await response.text();
+    if (!response.ok) {
+        return [null, decodeError<Code>(text)];
+    }
+    // string outputs come as plain text
+    if (response.headers.get("Content-Type")?.startsWith("text/plain")) {
+        return [text as T, null];
+    }
+    return [JSON.parse(text) as T, null];
+}
+
+export class StreamError extends Error {
+    error: RPCError
+    constructor(error: RPCError) {
+        super(error.message);
+        this.error = error;
+    }
+}
+
+export async function* stream<T>(proc: string, data: BodyInit): AsyncGenerator<T> {
+    const response = await post("/rpc/" + proc, data, { "Accept": "application/x-ndjson" });
+    if (!response.ok || !response.body) {
+        throw new StreamError(decodeError(await response.text()));
+    }
+    const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = "";
+    while (true) {
+        const { value, done } = await reader.read();
+        if (done) {
+            break;
+        }
+        buffer += value;
+        let newline: number;
+        while ((newline = buffer.indexOf("\n")) >= 0) {
+            const line = buffer.slice(0, newline);
+            buffer = buffer.slice(newline + 1);
+            if (!line) {
+                continue;
+            }
+            const msg = JSON.parse(line);
+            if (msg.error) {
+                throw new StreamError(msg.error);
+            }
+            yield msg.data as T;
+        }
+    }
+}
+
+// ---- websocket transport ----
+// When connected, json procs are called over the socket instead of http.
+
+let socket: WebSocket | null = null;
+let nextCallId = 1;
+const pendingCalls = new Map<number, (msg: any) => void>();
+const eventListeners = new Map<string, Set<(data: any) => void>>();
+
+function defaultSocketURL(): string {
+    if (baseURL) {
+        return baseURL.replace(/^http/, "ws") + "/ws";
+    }
+    const protocol = location.protocol === "https:" ? "wss://" : "ws://";
+    return protocol + location.host + "/ws";
+}
+
+export function connect(url: string = defaultSocketURL()): Promise<void> {
+    return new Promise((resolve, reject) => {
+        const ws = new WebSocket(url);
+        ws.onopen = () => {
+            socket = ws;
+            for (const event of eventListeners.keys()) {
+                ws.send(JSON.stringify({ type: "subscribe", event }));
+            }
+            resolve();
+        };
+        ws.onerror = () => reject(new Error("websocket connection failed"));
+        ws.onclose = () => {
+            if (socket === ws) {
+                socket = null;
+            }
+            for (const [id, resolveCall] of pendingCalls) {
+                pendingCalls.delete(id);
+                resolveCall({ type: "error", error: { code: "ConnectionClosed", message: "connection closed" } });
+            }
+        };
+        ws.onmessage = (e) => {
+            const msg = JSON.parse(e.data);
+            if (msg.type === "event") {
+                const listeners = eventListeners.get(msg.event);
+                listeners?.forEach(fn => fn(msg.data));
+                return;
+            }
+            const resolveCall = pendingCalls.get(msg.id);
+            if (resolveCall) {
+                pendingCalls.delete(msg.id);
+                resolveCall(msg);
+            }
+        };
+    });
+}
+
+export function disconnect() {
+    socket?.close();
+    socket = null;
+}
+
+// subscribe to a server pushed event; returns a function to unsubscribe
+export function subscribe(event: string, fn: (data: any) => void): () => void {
+    let listeners = eventListeners.get(event);
+    if (!listeners) {
+        listeners = new Set();
+        eventListeners.set(event, listeners);
+        socket?.send(JSON.stringify({ type: "subscribe", event }));
+    }
+    listeners.add(fn);
+    return () => {
+        listeners.delete(fn);
+        if (listeners.size === 0) {
+            eventListeners.delete(event);
+            socket?.send(JSON.stringify({ type: "unsubscribe", event }));
+        }
+    };
+}
+
+function callOverSocket<T, Code extends string>(proc: string, data: string): Promise<Response<T, Code>> {
+    const id = nextCallId++;
+    return new Promise(resolve => {
+        pendingCalls.set(id, (msg: any) => {
+            if (msg.type === "error") {
+                resolve([null, msg.error as RPCError<Code>]);
+            } else {
+                resolve([msg.data as T, null]);
+            }
+        });
+        socket!.send(`{"id":${id},"type":"call","proc":${JSON.stringify(proc)},"input":${data}}`);
+    });
+}
+
+// ---- batch calls ----
+// Typed by the ProcTypes interface of the generated bindings, which maps proc
+// names to [input, output]
+
+export type ProcTable<PT> = { [P in keyof PT]: [any, any] };
+
+export type BatchCall<PT extends ProcTable<PT>> = { [P in keyof PT]: { proc: P, input: PT[P][0] } }[keyof PT];
+
+export type BatchResults<PT extends ProcTable<PT>, C extends readonly BatchCall<PT>[], Code extends string = string> = {
+    [I in keyof C]: C[I] extends { proc: infer P extends keyof PT } ? Response<PT[P][1], Code> : never
+};
+
+// batch calls several procs in one round trip; results are in the same order
+export async function batch<PT extends ProcTable<PT>, const C extends readonly BatchCall<PT>[], Code extends string = string>(...calls: C): Promise<BatchResults<PT, C, Code>> {
+    const response = await post("/rpc-batch", JSON.stringify(calls));
+    if (!response.ok) {
+        const error = decodeError<Code>(await response.text());
+        return calls.map(() => [null, error]) as unknown as BatchResults<PT, C, Code>;
+    }
+    const results: any[] = await response.json();
+    return results.map(r => r.error ? [null, r.error] : [r.data, null]) as unknown as BatchResults<PT, C, Code>;
+}
+
+// ---- input validation ----
+// Same rules and messages as the server side validation (see validate.go)
+
+// field name -> rules, or [rules, nested struct rules] for fields that hold
+// structs; the nested rules are null when the struct has none
+export type ValidationRules = { [field: string]: string | [string, (() => ValidationRules) | null] };
+
+// validate returns a map of field path -> error message, or null if valid
+export function validate(data: any, rules: ValidationRules): Record<string, string> | null {
+    const errors: Record<string, string> = {};
+    validateInto(data, rules, "", errors);
+    return Object.keys(errors).length > 0 ? errors : null;
+}
+
+function validateInto(data: any, rules: ValidationRules, prefix: string, errors: Record<string, string>) {
+    if (data === null || data === undefined) {
+        return;
+    }
+    for (const field in rules) {
+        const entry = rules[field];
+        const [ruleText, nested] = typeof entry === "string" ? [entry, null] : entry;
+        const path = prefix + field;
+        const value = data[field];
+        const message = checkRules(value, ruleText, typeof entry !== "string");
+        if (message) {
+            errors[path] = message;
+            continue;
+        }
+        if (nested && value !== null && value !== undefined) {
+            if (Array.isArray(value)) {
+                value.forEach((item, i) => validateInto(item, nested(), `${path}[${i}].`, errors));
+            } else {
+                validateInto(value, nested(), path + ".", errors);
+            }
+        }
+    }
+}
+
+// like the server, structs are never empty; only maps are empty without keys
+function isEmptyValue(value: any, isStruct: boolean): boolean {
+    if (value === null || value === undefined || value === "" || value === 0 || value === false) {
+        return true;
+    }
+    if (Array.isArray(value)) {
+        return value.length === 0;
+    }
+    if (typeof value === "object") {
+        return !isStruct && Object.keys(value).length === 0;
+    }
+    return false;
+}
+
+const emailPattern = /^[^\s@]+@[^\s@]+\.[^\s@]+$/;
+
+function checkRules(value: any, ruleText: string, isStruct: boolean): string | null {
+    if (!ruleText) {
+        return null;
+    }
+    const rules = ruleText.split(",").map(r => r.trim());
+    if (isEmptyValue(value, isStruct)) {
+        return rules.includes("required") ? "is required" : null;
+    }
+    for (const rule of rules) {
+        const eq = rule.indexOf("=");
+        const name = eq < 0 ? rule : rule.slice(0, eq);
+        const arg = eq < 0 ? "" : rule.slice(eq + 1);
+        switch (name) {
+            case "min":
+            case "max": {
+                let size: number;
+                let unit = "";
+                if (typeof value === "string") {
+                    size = [...value].length;
+                    unit = " characters";
+                } else if (Array.isArray(value)) {
+                    size = value.length;
+                    unit = " items";
+                } else if (typeof value === "number") {
+                    size = value;
+                } else if (typeof value === "object") {
+                    size = Object.keys(value).length;
+                    unit = " items";
+                } else {
+                    continue;
+                }
+                if (name === "min" && size < Number(arg)) {
+                    return "must be at least " + arg + unit;
+                }
+                if (name === "max" && size > Number(arg)) {
+                    return "must be at most " + arg + unit;
+                }
+                break;
+            }
+            case "email":
+                if (!emailPattern.test(String(value))) {
+                    return "must be a valid email";
+                }
+                break;
+            case "oneof": {
+                const options = arg.split(" ").filter(o => o);
+                if (!options.includes(String(value))) {
+                    return "must be one of: " + options.join(", ");
+                }
+                break;
+            }
+        }
+    }
+    return null;
+}
+
+
+// ---- binary wire format ----
+// callBinary calls a json proc using MessagePack instead of json, which is
+// more compact for large payloads. Inputs are encoded like JSON.stringify
+// would encode them, and errors still come back as json.
+
+export async function callBinary<T, Code extends string = string>(proc: string, data: any): Promise<Response<T, Code>> {
+    const response = await post("/rpc/" + proc, msgpackEncode(data), {
+        "Content-Type": "application/msgpack",
+        "Accept": "application/msgpack",
+    });
+    if (!response.ok) {
+        return [null, decodeError<Code>(await response.text())];
+    }
+    const bytes = new Uint8Array(await response.arrayBuffer());
+    return [msgpackDecode(bytes), null];
+}
+
+export function msgpackEncode(value: any): Uint8Array {
+    const out: number[] = [];
+    encodeValue(out, value);
+    return new Uint8Array(out);
+}
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+function pushUint(out: number[], n: number, size: number) {
+    for (let i = size - 1; i >= 0; i--) {
+        out.push(Math.floor(n / 2 ** (8 * i)) & 0xff);
+    }
+}
+
+function pushHeader(out: number[], n: number, fix: number, code16: number, code32: number) {
+    if (n < 16) {
+        out.push(fix | n);
+    } else if (n <= 0xffff) {
+        out.push(code16);
+        pushUint(out, n, 2);
+    } else {
+        out.push(code32);
+        pushUint(out, n, 4);
+    }
+}
+
+function encodeValue(out: number[], value: any) {
+    if (value !== null && typeof value === "object" && typeof value.toJSON === "function") {
+        value = value.toJSON();
+    }
+    if (value === null || value === undefined) {
+        out.push(0xc0);
+    } else if (typeof value === "boolean") {
+        out.push(value ? 0xc3 : 0xc2);
+    } else if (typeof value === "number") {
+        if (Number.isSafeInteger(value)) {
+            if (value >= 0 && value <= 0x7f) {
+                out.push(value);
+            } else if (value < 0 && value >= -32) {
+                out.push(value & 0xff);
+            } else if (value >= 0) {
+                const size = value <= 0xff ? 1 : value <= 0xffff ? 2 : value <= 0xffffffff ? 4 : 8;
+                out.push(size === 1 ? 0xcc : size === 2 ? 0xcd : size === 4 ? 0xce : 0xcf);
+                pushUint(out, value, size);
+            } else {
+                const size = value >= -0x80 ? 1 : value >= -0x8000 ? 2 : value >= -0x80000000 ? 4 : 8;
+                out.push(size === 1 ? 0xd0 : size === 2 ? 0xd1 : size === 4 ? 0xd2 : 0xd3);
+                const view = new DataView(new ArrayBuffer(8));
+                view.setBigInt64(0, BigInt(value));
+                out.push(...new Uint8Array(view.buffer, 8 - size));
+            }
+        } else {
+            out.push(0xcb);
+            const view = new DataView(new ArrayBuffer(8));
+            view.setFloat64(0, value);
+            out.push(...new Uint8Array(view.buffer));
+        }
+    } else if (typeof value === "string") {
+        const bytes = textEncoder.encode(value);
+        if (bytes.length < 32) {
+            out.push(0xa0 | bytes.length);
+        } else if (bytes.length <= 0xff) {
+            out.push(0xd9, bytes.length);
+        } else if (bytes.length <= 0xffff) {
+            out.push(0xda);
+            pushUint(out, bytes.length, 2);
+        } else {
+            out.push(0xdb);
+            pushUint(out, bytes.length, 4);
+        }
+        for (const b of bytes) {
+            out.push(b);
+        }
+    } else if (value instanceof Uint8Array) {
+        if (value.length <= 0xff) {
+            out.push(0xc4, value.length);
+        } else if (value.length <= 0xffff) {
+            out.push(0xc5);
+            pushUint(out, value.length, 2);
+        } else {
+            out.push(0xc6);
+            pushUint(out, value.length, 4);
+        }
+        for (const b of value) {
+            out.push(b);
+        }
+    } else if (Array.isArray(value)) {
+        pushHeader(out, value.length, 0x90, 0xdc, 0xdd);
+        for (const item of value) {
+            encodeValue(out, item);
+        }
+    } else if (typeof value === "object") {
+        const keys = Object.keys(value).filter(k => value[k] !== undefined && typeof value[k] !== "function");
+        pushHeader(out, keys.length, 0x80, 0xde, 0xdf);
+        for (const key of keys) {
+            encodeValue(out, key);
+            encodeValue(out, value[key]);
+        }
+    } else {
+        out.push(0xc0);
+    }
+}
+
+export function msgpackDecode(bytes: Uint8Array): any {
+    const view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+    let pos = 0;
+
+    function str(n: number): string {
+        const s = textDecoder.decode(bytes.subarray(pos, pos + n));
+        pos += n;
+        return s;
+    }
+    function uint(size: number): number {
+        let n = 0;
+        for (let i = 0; i < size; i++) {
+            n = n * 256 + bytes[pos++];
+        }
+        return n;
+    }
+    function array(n: number): any[] {
+        const items = new Array(n);
+        for (let i = 0; i < n; i++) {
+            items[i] = next();
+        }
+        return items;
+    }
+    function map(n: number): Record<string, any> {
+        const obj: Record<string, any> = {};
+        for (let i = 0; i < n; i++) {
+            const key = next();
+            obj[String(key)] = next();
+        }
+        return obj;
+    }
+    function next(): any {
+        if (pos >= bytes.length) {
+            throw new Error("msgpack: unexpected end of data");
+        }
+        const code = bytes[pos++];
+        if (code <= 0x7f) return code;
+        if (code >= 0xe0) return code - 0x100;
+        if ((code & 0xe0) === 0xa0) return str(code & 0x1f);
+        if ((code & 0xf0) === 0x90) return array(code & 0x0f);
+        if ((code & 0xf0) === 0x80) return map(code & 0x0f);
+        let n: number;
+        switch (code) {
+            case 0xc0: return null;
+            case 0xc2: return false;
+            case 0xc3: return true;
+            case 0xcc: return uint(1);
+            case 0xcd: return uint(2);
+            case 0xce: return uint(4);
+            case 0xcf: return uint(8);
+            case 0xd0: n = view.getInt8(pos); pos += 1; return n;
+            case 0xd1: n = view.getInt16(pos); pos += 2; return n;
+            case 0xd2: n = view.getInt32(pos); pos += 4; return n;
+            case 0xd3: n = Number(view.getBigInt64(pos)); pos += 8; return n;
+            case 0xca: n = view.getFloat32(pos); pos += 4; return n;
+            case 0xcb: n = view.getFloat64(pos); pos += 8; return n;
+            case 0xd9: return str(uint(1));
+            case 0xda: return str(uint(2));
+            case 0xdb: return str(uint(4));
+            case 0xc4: case 0xc5: case 0xc6: {
+                n = uint(code === 0xc4 ? 1 : code === 0xc5 ? 2 : 4);
+                const data = bytes.slice(pos, pos + n);
+                pos += n;
+                return data;
+            }
+            case 0xdc: return array(uint(2));
+            case 0xdd: return array(uint(4));
+            case 0xde: return map(uint(2));
+            case 0xdf: return map(uint(4));
+        }
+        throw new Error("msgpack: unsupported code 0x" + code.toString(16));
+    }
+
+    return next();
+}
@@ -0,0 +1,342 @@
+package vbeam
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.hasen.dev/generic"
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+// ------------------------------------------
+// section: Scheduled tasks
+// ------------------------------------------
+//
+// Recurring work (nightly cleanups, digests) on a cron schedule:
+//
+//	app.Schedule("cleanup", "30 3 * * *", func(ctx *vbeam.Context) error {
+//		vbeam.UseWriteTx(ctx)
+//		...
+//	})
+//
+// Tasks get a Context (and transaction) like procs. Like jobs, they skip the
+// proc interceptors and go through the ones added with InterceptJobs, with
+// ProcCall.IsScheduled set. Their writes are committed along with the time
+// of the run when they return nil.
+//
+// The last successful run of each task is kept in the database. If the
+// program was down (or the task failed) when a run was due, the task runs
+// once as soon as it starts again; several missed runs are caught up by a
+// single run. A run that is still going when the next one is due delays it.
+//
+// Specs have the usual five fields: minute, hour, day of month, month, day of
+// week (0 or 7 is Sunday), in local time. Fields take numbers, *, lists
+// (1,15), ranges (1-5) and steps (*/10, 0-30/5). Also supported: @yearly,
+// @monthly, @weekly, @daily (or @midnight), @hourly, and @every <duration>
+// (e.g. "@every 10m").
+
+// last successful run of each task: name -> time
+var scheduleBucket = vbolt.Bucket(&dbInfo, "vbeam_schedule", vpack.StringZ, vpack.UnixTime)
+
+type scheduler struct {
+	mu       sync.Mutex
+	names    map[string]bool
+	stop     chan struct{} // closed to stop the tasks
+	stopping bool
+	loops    sync.WaitGroup
+
+	// parent of the running tasks' contexts; cancelled when shutting down
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// how long StopSchedules waits for running tasks before cancelling them
+const scheduleShutdownTimeout = 10 * time.Second
+
+// Schedule runs fn on the cron schedule spec, until StopSchedules is called
+// or the program exits through generic.ExitWithCleanup. It panics if the spec
+// is invalid or the name is taken.
+func (app *Application) Schedule(name string, spec string, fn func(ctx *Context) error) {
+	if app.DB == nil {
+		panic("scheduled tasks need a database")
+	}
+	schedule, err := parseCronSpec(spec)
+	if err != nil {
+		panic(fmt.Sprintf("cannot schedule %s: %v", name, err))
+	}
+	if schedule.next(time.Now()).IsZero() {
+		panic(fmt.Sprintf("cannot schedule %s: %q never runs", name, spec))
+	}
+
+	var s = &app.schedules
+	s.mu.Lock()
+	if s.names[name] {
+		s.mu.Unlock()
+		panic(fmt.Sprintf("cannot schedule %s: already scheduled", name))
+	}
+	if s.names == nil {
+		s.names = make(map[string]bool)
+		s.stop = make(chan struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		generic.AddExitCleanup(app.StopSchedules)
+	}
+	if s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.names[name] = true
+	s.loops.Add(1)
+	s.mu.Unlock()
+
+	go app.runSchedule(name, schedule, reflect.ValueOf(fn))
+}
+
+// StopSchedules stops the scheduled tasks. Running tasks get some time to
+// finish before their contexts are cancelled.
+func (app *Application) StopSchedules() {
+	var s = &app.schedules
+	s.mu.Lock()
+	if s.names == nil || s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.stopping = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	var finished = make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(scheduleShutdownTimeout):
+		log.Println("schedule: cancelling the tasks still running")
+		s.cancel()
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+		}
+	}
+	s.cancel()
+}
+
+func (app *Application) runSchedule(name string, schedule *cronSpec, fn reflect.Value) {
+	var s = &app.schedules
+	defer s.loops.Done()
+
+	var last = app.lastScheduledRun(name)
+	for {
+		var next = schedule.next(last)
+		if next.IsZero() {
+			log.Printf("schedule: %s has no more runs", name)
+			return
+		}
+		// wake up now and then rather than trusting one long timer, in case
+		// the wall clock is changed
+		for time.Now().Before(next) {
+			var timer = time.NewTimer(min(time.Until(next), time.Minute))
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		last = time.Now()
+		if err := app.runScheduledTask(name, fn, last); err != nil {
+			log.Printf("schedule: %s failed: %v", name, err)
+		}
+	}
+}
+
+// lastScheduledRun returns the time of the last successful run, or now for a
+// task that never ran (it first runs at its next scheduled time). The first
+// time a task is seen, now is stored, so runs missed from then on are caught
+// up.
+func (app *Application) lastScheduledRun(name string) time.Time {
+	var tx = vbolt.ReadTx(app.DB)
+	var last time.Time
+	vbolt.Read(tx, scheduleBucket, name, &last)
+	vbolt.TxClose(tx)
+	if !last.IsZero() {
+		return last
+	}
+
+	last = time.Now()
+	var wtx = vbolt.WriteTx(app.DB)
+	defer vbolt.TxClose(wtx)
+	vbolt.Write(wtx, scheduleBucket, name, &last)
+	if err := wtx.Commit(); err != nil {
+		log.Printf("schedule: could not store the first run of %s: %v", name, err)
+	}
+	return last
+}
+
+// runScheduledTask runs the task and records the run in the task's
+// transaction, so that its writes and the run are committed together
+func (app *Application) runScheduledTask(name string, fn reflect.Value, runAt time.Time) error {
+	var ctx = newContext(app, app.schedules.ctx, "")
+	defer CloseContext(&ctx)
+	var call = ProcCall{ProcName: name, IsScheduled: true}
+	_, err := app.callProc(&ctx, &call, fn)
+	if ctxErr := contextError(&ctx); ctxErr != nil {
+		err = ctxErr
+	}
+	if err == nil {
+		useWriteTxAfterProc(&ctx)
+		vbolt.Write(ctx.Tx, scheduleBucket, name, &runAt)
+	}
+	return finishTx(&ctx, err)
+}
+
+// cronSpec holds the allowed values of each field as bit sets
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	// when both days are restricted, either one matching is enough
+	domAny, dowAny bool
+
+	every time.Duration // for "@every"
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronSpec(spec string) (*cronSpec, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, found := strings.CutPrefix(spec, "@every "); found {
+		every, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("invalid interval in %q", spec)
+		}
+		return &cronSpec{every: every}, nil
+	}
+	if expanded, found := cronDescriptors[spec]; found {
+		spec = expanded
+	}
+
+	var fields = strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q", spec)
+	}
+	var c cronSpec
+	var err error
+	var parsers = []struct {
+		target   *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for index, p := range parsers {
+		if *p.target, err = parseCronField(fields[index], p.min, p.max); err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 { // 7 is also Sunday
+		c.dow |= 1
+	}
+	// like cron, "*/2" counts as unrestricted here
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepText, hasStep := strings.Cut(part, "/")
+		var step = 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		var lo, hi int
+		if rangePart == "*" {
+			lo, hi = min, max
+		} else if from, to, isRange := strings.Cut(rangePart, "-"); isRange {
+			lo, err = strconv.Atoi(from)
+			if err == nil {
+				hi, err = strconv.Atoi(to)
+			}
+		} else {
+			lo, err = strconv.Atoi(rangePart)
+			hi = lo
+			if hasStep { // "5/15" is "5-max/15"
+				hi = max
+			}
+		}
+		if err != nil || lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("invalid value %q (allowed: %d-%d)", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	var domMatch = c.dom&(1<<t.Day()) != 0
+	var dowMatch = c.dow&(1<<int(t.Weekday())) != 0
+	if !c.domAny && !c.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// next returns the first time after t that matches the spec, or the zero time
+// if there's none in the next few years (e.g. February 30th)
+func (c *cronSpec) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+	var loc = t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	var limit = t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,93 @@
+package vbeam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSpecErrors(t *testing.T) {
+	var specs = []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"@every",
+		"@every -1m",
+		"@every soon",
+		"@fortnightly",
+	}
+	for _, spec := range specs {
+		if _, err := parseCronSpec(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	var at = func(text string) time.Time {
+		t.Helper()
+		value, err := time.ParseInLocation("2006-01-02 15:04", text, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	// 2024-01-10 is a Wednesday
+	var tests = []struct {
+		spec     string
+		from     string
+		expected string
+	}{
+		{"* * * * *", "2024-01-10 12:00", "2024-01-10 12:01"},
+		{"30 3 * * *", "2024-01-10 12:00", "2024-01-11 03:30"},
+		{"30 3 * * *", "2024-01-10 03:29", "2024-01-10 03:30"},
+		{"*/15 * * * *", "2024-01-10 12:07", "2024-01-10 12:15"},
+		{"0-30/10 * * * *", "2024-01-10 12:31", "2024-01-10 13:00"},
+		{"5/20 * * * *", "2024-01-10 12:26", "2024-01-10 12:45"},
+		{"0 9 * * 1-5", "2024-01-12 10:00", "2024-01-15 09:00"},
+		{"0 0 * * 7", "2024-01-10 12:00", "2024-01-14 00:00"},
+		{"0 0 1,15 * *", "2024-01-10 12:00", "2024-01-15 00:00"},
+		{"0 0 31 * *", "2024-01-31 12:00", "2024-03-31 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// with both days restricted, either one matches
+		{"0 0 13 * 5", "2024-01-10 12:00", "2024-01-12 00:00"},
+		// a day field starting with * is not a restriction: odd days that are
+		// Mondays
+		{"0 0 */2 * 1", "2024-01-10 12:00", "2024-01-15 00:00"},
+		{"@hourly", "2024-01-10 12:00", "2024-01-10 13:00"},
+		{"@daily", "2024-01-10 12:00", "2024-01-11 00:00"},
+		{"@weekly", "2024-01-10 12:00", "2024-01-14 00:00"},
+		{"@monthly", "2024-01-10 12:00", "2024-02-01 00:00"},
+		{"@yearly", "2024-01-10 12:00", "2025-01-01 00:00"},
+		{"@every 90m", "2024-01-10 12:00", "2024-01-10 13:30"},
+	}
+	for _, test := range tests {
+		spec, err := parseCronSpec(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if next := spec.next(at(test.from)); !next.Equal(at(test.expected)) {
+			t.Errorf("%q from %s: expected %s, got %s", test.spec, test.from, test.expected, next.Format("2006-01-02 15:04"))
+		}
+	}
+}
+
+func TestCronNeverRuns(t *testing.T) {
+	spec, err := parseCronSpec("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := spec.next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected no next run for February 30th, got %s", next)
+	}
+}
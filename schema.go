@@ -0,0 +1,403 @@
+package vbeam
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.hasen.dev/vbeam/tsbridge"
+
+	"go.hasen.dev/generic"
+)
+
+// ------------------------------------------
+// section: API schema
+// ------------------------------------------
+//
+// An OpenAPI 3.1 document (whose schemas are plain JSON Schema) describing all
+// the /rpc/ and /data/ endpoints, for API tooling, contract tests and clients
+// in other languages.
+//
+// Enum values and error codes are read from the source of the procs'
+// packages, which a deployed binary doesn't have. So the document is made by
+// GenerateSchema during development, and the endpoint serves that file,
+// embedded in the binary:
+//
+//	//go:embed api/openapi.json
+//	var apiSchema []byte
+//
+//	app.EnableSchemaEndpoint(apiSchema)
+
+const PATH_SCHEMA = "/rpc-schema"
+
+type Schema = map[string]any
+
+// GenerateSchema writes the OpenAPI document for all registered procs
+func GenerateSchema(app *Application, targetFile string) {
+	if targetFile == "" {
+		fmt.Println("WARNING: targetFile not specified for", app.Name)
+		return
+	}
+
+	log.Println("Writing API schema:", targetFile)
+	var f, err = os.OpenFile(targetFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	var enc = json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	enc.Encode(BuildSchema(app))
+}
+
+// EnableSchemaEndpoint serves the OpenAPI document written by GenerateSchema
+// at PATH_SCHEMA. When doc is nil, the document is built right away, so call
+// it after registering the procs; that only works where the source is around.
+func (app *Application) EnableSchemaEndpoint(doc []byte) {
+	if doc == nil {
+		doc = generic.Must(json.Marshal(BuildSchema(app)))
+	}
+	app.HandleFunc(PATH_SCHEMA, func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+}
+
+func BuildSchema(app *Application) Schema {
+	var sb schemaBuilder
+	sb.codecs = app.codecs
+	sb.schemas = make(Schema)
+	sb.enums = make(map[reflect.Type][]any)
+	sb.keys = make(map[reflect.Type]string)
+	sb.keyTypes = make(map[string]reflect.Type)
+
+	// let the typescript bridge find enum values and error codes for us
+	for _, name := range app.procList {
+		proc := app.procMap[name]
+		if proc.InputType != httpRequestPtr {
+			sb.bridge.DecideTypescriptTypeName(proc.InputType)
+		}
+		sb.bridge.DecideTypescriptTypeName(proc.OutputType)
+		sb.bridge.QueuePackage(_ProcPackage(proc.ProcValue))
+	}
+	for _, proc := range app.dataProcMap {
+		sb.bridge.QueuePackage(_ProcPackage(proc.ProcValue))
+	}
+	sb.bridge.Process()
+	for _, e := range sb.bridge.Enums {
+		for _, c := range e.Consts {
+			sb.enums[e.Type] = append(sb.enums[e.Type], c.Value)
+		}
+	}
+
+	var paths = make(Schema)
+	for _, name := range app.procList {
+		proc := app.procMap[name]
+		paths[PREFIX_RPC+name] = Schema{"post": sb.procOperation(&proc)}
+	}
+	for name := range app.dataProcMap {
+		paths[PREFIX_DATA+name] = Schema{"get": Schema{
+			"operationId": name,
+			"responses": Schema{
+				"200": Schema{
+					"description": "Downloadable content",
+					"content": Schema{
+						"application/octet-stream": Schema{"schema": Schema{"type": "string", "format": "binary"}},
+					},
+				},
+				"default": sb.errorResponse(),
+			},
+		}}
+	}
+
+	sb.schemas["RPCError"] = sb.errorSchema()
+
+	return Schema{
+		"openapi": "3.1.0",
+		"info": Schema{
+			"title":   app.Name,
+			"version": "1",
+		},
+		"paths": paths,
+		"components": Schema{
+			"schemas": sb.schemas,
+			"securitySchemes": Schema{
+				"token": Schema{"type": "apiKey", "in": "header", "name": "x-auth-token"},
+				"cookie": Schema{
+					"type": "apiKey", "in": "cookie", "name": "authToken",
+					"description": "Calls must also send the csrfToken cookie in the " + CSRFHeaderName + " header",
+				},
+			},
+		},
+	}
+}
+
+type schemaBuilder struct {
+	bridge  tsbridge.Bridge
+	schemas Schema
+	enums   map[reflect.Type][]any
+	codecs  []Codec
+
+	// component names; see componentKey
+	keys     map[reflect.Type]string
+	keyTypes map[string]reflect.Type
+}
+
+var componentKeyInvalid = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// componentKey names the component for a named type. Types are named after
+// themselves, except when another type (from another package) has the same
+// name: those get qualified by their package path
+func (sb *schemaBuilder) componentKey(t reflect.Type) string {
+	if key, ok := sb.keys[t]; ok {
+		return key
+	}
+	var key = componentKeyInvalid.ReplaceAllString(t.Name(), "_")
+	if other, taken := sb.keyTypes[key]; taken && other != t {
+		key = componentKeyInvalid.ReplaceAllString(strings.ReplaceAll(t.PkgPath(), "/", ".")+"."+t.Name(), "_")
+	}
+	sb.keys[t] = key
+	sb.keyTypes[key] = t
+	return key
+}
+
+// codecContent lists the same schema under json and every other codec
+func (sb *schemaBuilder) codecContent(schema Schema) Schema {
+	var content = Schema{JSONCodec.ContentType(): Schema{"schema": schema}}
+	for _, codec := range sb.codecs {
+		content[codec.ContentType()] = Schema{"schema": schema}
+	}
+	return content
+}
+
+func (sb *schemaBuilder) errorResponse() Schema {
+	return Schema{
+		"description": "Error",
+		"content": Schema{
+			"application/json": Schema{"schema": Schema{"$ref": "#/components/schemas/RPCError"}},
+		},
+	}
+}
+
+func (sb *schemaBuilder) errorSchema() Schema {
+	var codes []any
+	for _, e := range builtinErrors {
+		codes = append(codes, e.Error())
+	}
+	for _, e := range sb.bridge.Errors {
+		if code, err := strconv.Unquote(e.Value); err == nil {
+			codes = append(codes, code)
+		}
+	}
+	var codeSchema = Schema{"type": "string"}
+	if len(codes) > 0 {
+		// other codes are possible, so these are listed as examples
+		codeSchema["examples"] = codes
+	}
+	return Schema{
+		"type": "object",
+		"properties": Schema{
+			"code":    codeSchema,
+			"message": Schema{"type": "string"},
+			"fields": Schema{
+				"type":                 "object",
+				"additionalProperties": Schema{"type": "string"},
+			},
+			"details":    Schema{},
+			"retryAfter": Schema{"type": "integer"},
+		},
+		"required": []string{"code", "message"},
+	}
+}
+
+func (sb *schemaBuilder) procOperation(proc *ProcedureInfo) Schema {
+	var op = Schema{"operationId": proc.ProcName}
+	if proc.Options.Description != "" {
+		op["description"] = proc.Options.Description
+	}
+	if proc.Options.Deprecated {
+		op["deprecated"] = true
+	}
+	if proc.Options.AuthRequired {
+		op["security"] = []Schema{{"token": []string{}}, {"cookie": []string{}}}
+	}
+	if !proc.Stream {
+		op["parameters"] = []Schema{{
+			"name":        IdempotencyHeader,
+			"in":          "header",
+			"required":    false,
+			"description": "Retries with the same key get the first response instead of running the procedure again",
+			"schema":      Schema{"type": "string", "maxLength": MaxIdempotencyKeyLength},
+		}}
+	}
+
+	if proc.InputType == httpRequestPtr {
+		op["requestBody"] = Schema{
+			"content": Schema{
+				"application/octet-stream": Schema{"schema": Schema{"type": "string", "format": "binary"}},
+			},
+		}
+	} else {
+		op["requestBody"] = Schema{
+			"required": true,
+			"content":  sb.codecContent(sb.typeSchema(proc.InputType)),
+		}
+	}
+
+	var okResponse Schema
+	if proc.Stream {
+		var item = sb.typeSchema(proc.OutputType)
+		okResponse = Schema{
+			"description": "Stream of items",
+			"content": Schema{
+				"application/x-ndjson": Schema{"schema": Schema{
+					"type":       "object",
+					"properties": Schema{"data": item, "error": Schema{"$ref": "#/components/schemas/RPCError"}},
+				}},
+				"text/event-stream": Schema{"schema": Schema{"type": "string"}},
+			},
+		}
+	} else if isPlainTextType(proc.OutputType) {
+		var content = sb.codecContent(Schema{"type": "string"})
+		delete(content, JSONCodec.ContentType())
+		content["text/plain"] = Schema{"schema": Schema{"type": "string"}}
+		okResponse = Schema{
+			"description": "Success",
+			"content":     content,
+		}
+	} else {
+		okResponse = Schema{
+			"description": "Success",
+			"content":     sb.codecContent(sb.typeSchema(proc.OutputType)),
+		}
+	}
+	op["responses"] = Schema{
+		"200":     okResponse,
+		"default": sb.errorResponse(),
+	}
+	return op
+}
+
+// typeSchema returns the JSON Schema for values of type t as encoded by
+// encoding/json. Named structs and enums are added to the components and
+// referenced.
+func (sb *schemaBuilder) typeSchema(t reflect.Type) Schema {
+	switch t.Kind() {
+	case reflect.Struct:
+		if t == timeType {
+			return Schema{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		var key = sb.componentKey(t)
+		if _, ok := sb.schemas[key]; !ok {
+			sb.schemas[key] = Schema{} // placeholder for recursive types
+			sb.schemas[key] = sb.structSchema(t)
+		}
+		return Schema{"$ref": "#/components/schemas/" + key}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sb.enumSchema(t, Schema{"type": "integer"})
+	case reflect.Float32, reflect.Float64:
+		return sb.enumSchema(t, Schema{"type": "number"})
+	case reflect.String:
+		return sb.enumSchema(t, Schema{"type": "string"})
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+
+	case reflect.Slice, reflect.Array:
+		if t == bytesType {
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		var s = Schema{"type": "array", "items": sb.typeSchema(t.Elem())}
+		if t.Kind() == reflect.Slice {
+			// nil slices are encoded as null
+			return Schema{"anyOf": []Schema{s, {"type": "null"}}}
+		}
+		return s
+	case reflect.Map:
+		return Schema{
+			"type":                 "object",
+			"additionalProperties": sb.typeSchema(t.Elem()),
+		}
+	case reflect.Ptr:
+		return Schema{"anyOf": []Schema{sb.typeSchema(t.Elem()), {"type": "null"}}}
+	default:
+		// interfaces and anything else: no constraints
+		return Schema{}
+	}
+}
+
+func (sb *schemaBuilder) enumSchema(t reflect.Type, base Schema) Schema {
+	if t.Name() == t.Kind().String() {
+		return base
+	}
+	if values, ok := sb.enums[t]; ok {
+		var key = sb.componentKey(t)
+		if _, ok := sb.schemas[key]; !ok {
+			base["enum"] = values
+			sb.schemas[key] = base
+		}
+		return Schema{"$ref": "#/components/schemas/" + key}
+	}
+	return base
+}
+
+func (sb *schemaBuilder) structSchema(t reflect.Type) Schema {
+	var properties = make(Schema)
+	var required []string
+	sb.addStructFields(t, properties, &required)
+	var s = Schema{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (sb *schemaBuilder) addStructFields(t reflect.Type, properties Schema, required *[]string) {
+	for index := 0; index < t.NumField(); index++ {
+		var field = t.Field(index)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			sb.addStructFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		var name = field.Name
+		var omitEmpty = false
+		var jsonTag = field.Tag.Get("json")
+		if jsonTag != "" {
+			var parts = strings.Split(jsonTag, ",")
+			if parts[0] == "-" && len(parts) == 1 {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+		properties[name] = sb.typeSchema(field.Type)
+		if !omitEmpty {
+			*required = append(*required, name)
+		}
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var bytesType = reflect.TypeOf([]byte{})
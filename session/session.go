@@ -0,0 +1,353 @@
+// Package session is a session store for vbeam applications, kept in the
+// application's vbolt database.
+//
+//	func main() {
+//		...
+//		session.Enable(app, session.Options{TTL: 7 * 24 * time.Hour})
+//	}
+//
+//	func Login(ctx *vbeam.Context, req LoginRequest) (resp LoginResponse, err error) {
+//		user, err := checkPassword(ctx, req)
+//		if err != nil {
+//			return
+//		}
+//		resp.Token, err = session.Create(ctx, user.Id)
+//		return
+//	}
+//
+//	func Logout(ctx *vbeam.Context, req vbeam.Empty) (vbeam.Empty, error) {
+//		return req, session.Destroy(ctx)
+//	}
+//
+// Create sets the authToken cookie that vbeam reads the token from, so
+// browsers are logged in right away; other clients can send the returned
+// token in the x-auth-token header. Procs get the session with ctx.Session()
+// and ctx.UserID().
+//
+// Sessions expire after TTL without use; every use pushes the expiry back.
+// Expired sessions are purged at startup, and then at most hourly when new
+// sessions are created.
+// Session writes (Create, Destroy, Revoke, RevokeAll) happen in the context's
+// write transaction, along with the rest of the proc's writes.
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.hasen.dev/vbeam"
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+// the cookie MakeContext reads the token from
+const CookieName = "authToken"
+
+var SessionNotFound = errors.New("SessionNotFound")
+
+type Options struct {
+	// How long a session lasts without being used. Defaults to 30 days
+	TTL time.Duration
+
+	// Send the cookie over plain http too; only for local development
+	InsecureCookie bool
+}
+
+const DefaultTTL = 30 * 24 * time.Hour
+
+var dbInfo vbolt.Info
+
+func packSession(self *vbeam.Session, buf *vpack.Buffer) {
+	vpack.Version(1, buf)
+	vpack.String(&self.Id, buf)
+	vpack.Int(&self.UserID, buf)
+	vpack.UnixTime(&self.CreatedAt, buf)
+	vpack.UnixTime(&self.LastSeen, buf)
+	vpack.UnixTime(&self.ExpiresAt, buf)
+	vpack.String(&self.IP, buf)
+}
+
+func packSessionIds(self *[]string, buf *vpack.Buffer) {
+	vpack.Slice(self, vpack.String, buf)
+}
+
+// session id => session
+var sessionsBucket = vbolt.Bucket(&dbInfo, "vbeam_sessions", vpack.StringZ, packSession)
+
+// user id => session ids; for listing the sessions of a user
+var userSessionsBucket = vbolt.Bucket(&dbInfo, "vbeam_user_sessions", vpack.FInt, packSessionIds)
+
+type store struct {
+	db      *vbolt.DB
+	options Options
+
+	// expired sessions are purged when sessions are created, at most this
+	// often
+	purgeMu   sync.Mutex
+	lastPurge time.Time
+}
+
+const purgeInterval = time.Hour
+
+// stores by app name; procs only have the context to go by
+var stores = make(map[string]*store)
+var storesMu sync.Mutex
+
+// Enable makes the application keep its sessions in its database, and sets it
+// as the app's SessionStore
+func Enable(app *vbeam.Application, options Options) {
+	if app.DB == nil {
+		panic("session: the application has no database")
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultTTL
+	}
+	var s = &store{db: app.DB, options: options}
+
+	vbolt.InitBuckets(app.DB, &dbInfo)
+	var tx = vbolt.WriteTx(app.DB)
+	defer vbolt.TxClose(tx)
+	var purged = purgeExpired(tx, time.Now())
+	s.lastPurge = time.Now()
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	if purged > 0 {
+		log.Printf("session: purged %d expired sessions", purged)
+	}
+
+	storesMu.Lock()
+	stores[app.Name] = s
+	storesMu.Unlock()
+	app.Sessions = s
+}
+
+func storeFor(ctx *vbeam.Context) *store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	var s = stores[ctx.AppName]
+	if s == nil {
+		panic(fmt.Sprintf("session: not enabled for %s", ctx.AppName))
+	}
+	return s
+}
+
+// tokens are never stored; sessions are keyed by a hash of the token
+func sessionId(token string) string {
+	var sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+func getSession(tx *vbolt.Tx, id string) *vbeam.Session {
+	var session vbeam.Session
+	if !vbolt.Read(tx, sessionsBucket, id, &session) {
+		return nil
+	}
+	return &session
+}
+
+func putSession(tx *vbolt.Tx, session *vbeam.Session) {
+	vbolt.Write(tx, sessionsBucket, session.Id, session)
+	var ids []string
+	vbolt.Read(tx, userSessionsBucket, session.UserID, &ids)
+	if !slices.Contains(ids, session.Id) {
+		ids = append(ids, session.Id)
+		vbolt.Write(tx, userSessionsBucket, session.UserID, &ids)
+	}
+}
+
+func deleteSession(tx *vbolt.Tx, session *vbeam.Session) {
+	vbolt.Delete(tx, sessionsBucket, session.Id)
+	var ids []string
+	vbolt.Read(tx, userSessionsBucket, session.UserID, &ids)
+	ids = slices.DeleteFunc(ids, func(id string) bool { return id == session.Id })
+	if len(ids) == 0 {
+		vbolt.Delete(tx, userSessionsBucket, session.UserID)
+	} else {
+		vbolt.Write(tx, userSessionsBucket, session.UserID, &ids)
+	}
+}
+
+func purgeExpired(tx *vbolt.Tx, now time.Time) (count int) {
+	var expired []vbeam.Session
+	vbolt.IterateAll(tx, sessionsBucket, func(id string, session vbeam.Session) bool {
+		if now.After(session.ExpiresAt) {
+			expired = append(expired, session)
+		}
+		return true
+	})
+	for index := range expired {
+		deleteSession(tx, &expired[index])
+	}
+	return len(expired)
+}
+
+// purgeDue reports whether it's time to purge again, and if so counts the
+// purge as done
+func (s *store) purgeDue(now time.Time) bool {
+	s.purgeMu.Lock()
+	defer s.purgeMu.Unlock()
+	if now.Sub(s.lastPurge) < purgeInterval {
+		return false
+	}
+	s.lastPurge = now
+	return true
+}
+
+func (s *store) cookie(token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   !s.options.InsecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sessions are extended at most this often, to avoid a write on every call
+func (s *store) refreshInterval() time.Duration {
+	return min(s.options.TTL/10, 5*time.Minute)
+}
+
+func (s *store) LoadSession(ctx *vbeam.Context) *vbeam.Session {
+	if ctx.Tx == nil {
+		return nil
+	}
+	var session = getSession(ctx.Tx, sessionId(ctx.Token))
+	if session == nil || time.Now().After(session.ExpiresAt) {
+		return nil
+	}
+	if ctx.TokenFromCookie() && time.Since(session.LastSeen) >= s.refreshInterval() {
+		// the stored expiry is extended by TouchSession; the cookie's has to
+		// be extended with the response. Clients that send the header keep
+		// the token themselves and never get the cookie.
+		ctx.SetCookie(s.cookie(ctx.Token, time.Now().Add(s.options.TTL)))
+	}
+	return session
+}
+
+func (s *store) TouchSession(session *vbeam.Session) {
+	var now = time.Now()
+	if now.Sub(session.LastSeen) < s.refreshInterval() {
+		return
+	}
+	var tx = vbolt.WriteTx(s.db)
+	defer vbolt.TxClose(tx)
+	var stored = getSession(tx, session.Id)
+	if stored == nil { // revoked in the meantime
+		return
+	}
+	stored.LastSeen = now
+	stored.ExpiresAt = now.Add(s.options.TTL)
+	putSession(tx, stored)
+	if err := tx.Commit(); err != nil {
+		log.Println("session: could not extend session:", err)
+	}
+}
+
+// Create starts a new session for the user, sets the auth cookie and makes it
+// the context's session. It returns the token for clients that don't use
+// cookies.
+func Create(ctx *vbeam.Context, userID int) (token string, err error) {
+	var s = storeFor(ctx)
+	vbeam.UseWriteTx(ctx)
+	token = newToken()
+	var now = time.Now()
+	var session = &vbeam.Session{
+		Id:        sessionId(token),
+		UserID:    userID,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(s.options.TTL),
+		IP:        ctx.ClientIP(),
+	}
+	putSession(ctx.Tx, session)
+	if s.purgeDue(now) {
+		purgeExpired(ctx.Tx, now)
+	}
+	ctx.SetCookie(s.cookie(token, session.ExpiresAt))
+	ctx.SetSession(token, session)
+	return token, nil
+}
+
+// Destroy ends the context's session (if any) and clears the auth cookie
+func Destroy(ctx *vbeam.Context) error {
+	var s = storeFor(ctx)
+	if session := ctx.Session(); session != nil {
+		vbeam.UseWriteTx(ctx)
+		deleteSession(ctx.Tx, session)
+	}
+	var cookie = s.cookie("", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	ctx.SetCookie(cookie)
+	ctx.SetSession("", nil)
+	return nil
+}
+
+// List returns the unexpired sessions of the user, oldest first
+func List(ctx *vbeam.Context, userID int) []vbeam.Session {
+	storeFor(ctx)
+	var sessions []vbeam.Session
+	var now = time.Now()
+	var ids []string
+	vbolt.Read(ctx.Tx, userSessionsBucket, userID, &ids)
+	for _, id := range ids {
+		var session = getSession(ctx.Tx, id)
+		if session != nil && now.Before(session.ExpiresAt) {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// Revoke ends one of the current user's sessions by its id (from List). The
+// sessions of other users are SessionNotFound, so ids can't be probed.
+func Revoke(ctx *vbeam.Context, id string) error {
+	storeFor(ctx)
+	var session = getSession(ctx.Tx, id)
+	if session == nil || ctx.UserID() == 0 || session.UserID != ctx.UserID() {
+		return SessionNotFound
+	}
+	vbeam.UseWriteTx(ctx)
+	deleteSession(ctx.Tx, session)
+	return nil
+}
+
+// RevokeAll ends all the sessions of the user, e.g. after a password change.
+// The current session is kept if it belongs to the user and keepCurrent is set.
+func RevokeAll(ctx *vbeam.Context, userID int, keepCurrent bool) error {
+	var current = ctx.Session()
+	var sessions = List(ctx, userID)
+	vbeam.UseWriteTx(ctx)
+	for index := range sessions {
+		var session = &sessions[index]
+		if keepCurrent && current != nil && current.Id == session.Id {
+			continue
+		}
+		deleteSession(ctx.Tx, session)
+	}
+	return nil
+}
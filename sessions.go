@@ -0,0 +1,104 @@
+package vbeam
+
+import (
+	"net/http"
+	"time"
+)
+
+// ------------------------------------------
+// section: Sessions
+// ------------------------------------------
+//
+// The token on the context usually identifies a user session. When the
+// application has a SessionStore (see the vbeam/session package), procs can
+// get the session behind the token with ctx.Session() and ctx.UserID(), and
+// AuthRequired procs need a valid session rather than just a token.
+
+type Session struct {
+	// identifies the session in listings; it's not the token
+	Id     string
+	UserID int
+
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+
+	// where the session was created from
+	IP string
+}
+
+type SessionStore interface {
+	// LoadSession returns the valid session for ctx.Token, or nil
+	LoadSession(ctx *Context) *Session
+
+	// TouchSession is called after the context of a call that loaded the
+	// session is closed, so the store can extend the session's expiry
+	// without holding up the call's transaction. It's not called for in
+	// process calls (see Call), which can be nested in a call that still
+	// holds the write transaction
+	TouchSession(session *Session)
+}
+
+// Session returns the session for the context's token, or nil if there is no
+// valid session (or no SessionStore). It's loaded on first use.
+func (ctx *Context) Session() *Session {
+	if !ctx.sessionLoaded {
+		ctx.sessionLoaded = true
+		if ctx.Token != "" && ctx.app != nil && ctx.app.Sessions != nil {
+			ctx.session = ctx.app.Sessions.LoadSession(ctx)
+		}
+	}
+	return ctx.session
+}
+
+// UserID returns the user of the current session, or 0 if there is none
+func (ctx *Context) UserID() int {
+	if session := ctx.Session(); session != nil {
+		return session.UserID
+	}
+	return 0
+}
+
+// SetSession replaces the session (and token) of the context, for the rest of
+// the call; used when logging in and out
+func (ctx *Context) SetSession(token string, session *Session) {
+	ctx.Token = token
+	ctx.session = session
+	ctx.sessionLoaded = true
+}
+
+// SetCookie adds a cookie to the http response of the call. Calls that are not
+// made over http (in process, websocket) have nowhere to send it, so it's
+// dropped. Cookies without a SameSite mode are sent as SameSite=Lax.
+//
+// Cookies are only sent when the call succeeds and its writes are committed,
+// so a failed login doesn't leave the client with the token of a session that
+// was rolled back. Stream procs send their response headers with the first
+// item, before anything is committed, so their cookies are dropped too.
+func (ctx *Context) SetCookie(cookie *http.Cookie) {
+	if ctx.stream {
+		return
+	}
+	ctx.cookies = append(ctx.cookies, cookie)
+}
+
+// TokenFromCookie reports whether ctx.Token came from the authToken cookie, as
+// opposed to the x-auth-token header or the caller of Call
+func (ctx *Context) TokenFromCookie() bool {
+	return ctx.tokenFromCookie
+}
+
+// ClientIP is the ip address of the client making the call; empty for in
+// process calls
+func (ctx *Context) ClientIP() string {
+	return ctx.clientIP
+}
+
+func writeCookies(w http.ResponseWriter, ctx *Context) {
+	for _, cookie := range ctx.cookies {
+		if cookie.SameSite == http.SameSiteDefaultMode {
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+		http.SetCookie(w, cookie)
+	}
+}
@@ -0,0 +1,114 @@
+package vbeam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Stream procs send their items as they are emitted, either as Server-Sent
+// Events (when the client accepts text/event-stream) or as newline delimited
+// json. In ndjson mode, each line is either {"data": item} or {"error": err}.
+//
+// Errors that happen before the first item is emitted are sent as a regular
+// error response. The response starts before the proc's writes are committed,
+// so stream procs can't set cookies (e.g. log in); see SetCookie.
+
+type streamWriter struct {
+	w       *ResponseWriter
+	ctx     *Context
+	sse     bool
+	started bool
+}
+
+func (s *streamWriter) start() {
+	header := s.w.Header()
+	if s.sse {
+		header.Set("Content-Type", "text/event-stream")
+	} else {
+		header.Set("Content-Type", "application/x-ndjson")
+	}
+	header.Set("Cache-Control", "no-cache")
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+}
+
+func (s *streamWriter) flush() error {
+	err := http.NewResponseController(s.w).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (s *streamWriter) send(item any) error {
+	if err := contextError(s.ctx); err != nil {
+		return err
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if !s.started {
+		s.start()
+	}
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "{\"data\":%s}\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *streamWriter) finish(err error) {
+	if err == nil {
+		if !s.started {
+			s.start()
+		}
+		return
+	}
+	if !s.started {
+		RespondError(s.w, err)
+		return
+	}
+	data, _ := json.Marshal(AsError(err))
+	if s.sse {
+		fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprintf(s.w, "{\"error\":%s}\n", data)
+	}
+	s.flush()
+}
+
+func (app *Application) handleStream(w *ResponseWriter, request *http.Request, proc *ProcedureInfo, input reflect.Value) {
+	var s = streamWriter{
+		w:   w,
+		sse: strings.Contains(request.Header.Get("Accept"), "text/event-stream"),
+	}
+
+	var err error
+	procStart := time.Now()
+	func() { // Go version of a scoped defer
+		var ctx = MakeContext(app, request)
+		defer CloseContext(&ctx)
+		ctx.stream = true
+		s.ctx = &ctx
+
+		var emitType = proc.ProcValue.Type().In(2)
+		var emit = reflect.MakeFunc(emitType, func(args []reflect.Value) []reflect.Value {
+			var err = s.send(args[0].Interface())
+			return []reflect.Value{reflect.ValueOf(&err).Elem()}
+		})
+		_, err = app.runProc(&ctx, proc, input, emit)
+	}()
+	w.procDur = time.Since(procStart)
+
+	s.finish(err)
+}
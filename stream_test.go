@@ -0,0 +1,36 @@
+package vbeam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func StreamItemsWithCookie(ctx *Context, input testWrite, emit func(string) error) error {
+	ctx.SetCookie(&http.Cookie{Name: "streamed", Value: input.Value})
+	if err := emit(input.Name); err != nil {
+		return err
+	}
+	return emit(input.Value)
+}
+
+func TestStreamDoesNotSendCookies(t *testing.T) {
+	var app = newTestApp(t)
+	RegisterStreamProc(app, StreamItemsWithCookie)
+
+	var request = httptest.NewRequest("POST", "/rpc/StreamItemsWithCookie", strings.NewReader(`{"Name": "a", "Value": "1"}`))
+	var recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the stream to run, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if body := recorder.Body.String(); body != "{\"data\":\"a\"}\n{\"data\":\"1\"}\n" {
+		t.Fatalf("unexpected stream: %q", body)
+	}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "streamed" {
+			t.Fatal("the stream's cookie was sent before its writes were committed")
+		}
+	}
+}
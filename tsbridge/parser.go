@@ -28,6 +28,9 @@ func (b *Bridge) ProcessPackage(pkgPath string) {
 	var enumTypesMap = make(map[string]*EnumInfo)
 	for idx := range b.Enums {
 		e := &b.Enums[idx]
+		if e.Type != nil && e.Type.PkgPath() != pkgPath {
+			continue // the package's consts can't be of this type
+		}
 		enumTypesMap[e.Name] = e
 	}
 
@@ -23,6 +23,18 @@ type Bridge struct {
 	// packages we want to process consts for
 	QueuedPackages    []string
 	ProcessedPackages []string
+
+	// Name the client runtime is imported as (see vbeam). When set, the
+	// ValidationRules and BuiltinErrorCode types are taken from it
+	Runtime string
+}
+
+// runtimeType qualifies the name of a type declared by the client runtime
+func (b *Bridge) runtimeType(name string) string {
+	if b.Runtime == "" {
+		return name
+	}
+	return b.Runtime + "." + name
 }
 
 type StructInfo struct {
@@ -34,12 +46,22 @@ type StructField struct {
 	Name       string
 	TypeName   string
 	TypeCustom bool
+
+	// validation rules from the `validate` tag
+	Validate string
+
+	// name of the struct type behind the field (directly or through pointers
+	// and slices), so its validation rules can be applied to nested values
+	ElemStruct string
 }
 
 type EnumInfo struct {
 	Name     string
 	TypeName string
 	Consts   []ConstValue
+
+	// the Go type; enums from different packages can share a name
+	Type reflect.Type
 }
 
 type ErrorInfo struct {
@@ -117,6 +139,7 @@ func (b *Bridge) processType(t reflect.Type) {
 		var einfo EnumInfo
 		einfo.Name = t.Name()
 		einfo.TypeName = DecideEnumTypeName(t)
+		einfo.Type = t
 		b.Enums = append(b.Enums, einfo)
 		b.ProcessedTypes = append(b.ProcessedTypes, t)
 	}
@@ -155,6 +178,8 @@ func (b *Bridge) AddStructFields(sinfo *StructInfo, t reflect.Type) {
 		if !sField.TypeCustom {
 			sField.TypeName = b.DecideTypescriptTypeName(field.Type)
 		}
+		sField.Validate = field.Tag.Get("validate")
+		sField.ElemStruct = structElemName(field.Type)
 		sinfo.Fields = append(sinfo.Fields, sField)
 	}
 }
@@ -170,6 +195,16 @@ func DecideEnumTypeName(t reflect.Type) string {
 	}
 }
 
+func structElemName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return ""
+	}
+	return t.Name()
+}
+
 var timeType = reflect.TypeOf(time.Time{})
 var bytesType = reflect.TypeOf([]byte{})
 
@@ -182,6 +217,8 @@ func (b *Bridge) DecideTypescriptTypeName(t reflect.Type) string {
 		// special cases:
 		if t == timeType { // time is always serialized as a string
 			return "string"
+		} else if t.Name() == "" { // anonymous struct; spell it out
+			return b.inlineStructTypeName(t)
 		} else {
 			b.QueueType(t)
 			return t.Name()
@@ -212,6 +249,10 @@ func (b *Bridge) DecideTypescriptTypeName(t reflect.Type) string {
 			if elementType == "" {
 				return ""
 			}
+			if strings.Contains(elementType, " | ") {
+				// (T | null)[], not T | null[]
+				elementType = "(" + elementType + ")"
+			}
 			return elementType + "[]"
 		}
 	case reflect.Map:
@@ -238,6 +279,19 @@ func (b *Bridge) DecideTypescriptTypeName(t reflect.Type) string {
 	}
 }
 
+func (b *Bridge) inlineStructTypeName(t reflect.Type) string {
+	var sinfo StructInfo
+	b.AddStructFields(&sinfo, t)
+	var fields []string
+	for _, field := range sinfo.Fields {
+		fields = append(fields, fmt.Sprintf("%s: %s", field.Name, field.TypeName))
+	}
+	if len(fields) == 0 {
+		return "{}"
+	}
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
 func WriteStructTSBinding(b *Bridge, w io.Writer) {
 	for index := range b.Enums {
 		var einfo = &b.Enums[index]
@@ -261,6 +315,11 @@ func WriteStructTSBinding(b *Bridge, w io.Writer) {
 		fmt.Fprintln(w)
 	}
 
+	WriteErrorCodeTSBinding(b, w)
+
+	// the ValidationRules type is declared by the client runtime (see vbeam)
+	var hasRules = structsWithValidation(b)
+
 	for index := range b.Structs {
 		var sinfo = &b.Structs[index]
 		fmt.Fprintf(w, "export interface %s {\n", sinfo.Name)
@@ -269,5 +328,77 @@ func WriteStructTSBinding(b *Bridge, w io.Writer) {
 			fmt.Fprintf(w, "    %s: %s\n", field.Name, field.TypeName)
 		}
 		fmt.Fprintf(w, "}\n\n")
+
+		if hasRules[sinfo.Name] {
+			writeValidationRulesTSBinding(b, sinfo, hasRules, w)
+		}
+	}
+}
+
+// structsWithValidation finds the structs that have validation rules on their
+// fields or on the fields of structs nested in them
+func structsWithValidation(b *Bridge) map[string]bool {
+	var result = make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for index := range b.Structs {
+			var sinfo = &b.Structs[index]
+			if result[sinfo.Name] {
+				continue
+			}
+			for findex := range sinfo.Fields {
+				var field = &sinfo.Fields[findex]
+				if field.Validate != "" || result[field.ElemStruct] {
+					result[sinfo.Name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// WriteValidationRulesTSBinding writes the validation rules of a struct as a
+// const named after it, e.g. SignupRequestRules
+func WriteValidationRulesTSBinding(sinfo *StructInfo, hasRules map[string]bool, w io.Writer) {
+	var b Bridge
+	writeValidationRulesTSBinding(&b, sinfo, hasRules, w)
+}
+
+func writeValidationRulesTSBinding(b *Bridge, sinfo *StructInfo, hasRules map[string]bool, w io.Writer) {
+	fmt.Fprintf(w, "export const %sRules: %s = {\n", sinfo.Name, b.runtimeType("ValidationRules"))
+	for findex := range sinfo.Fields {
+		var field = &sinfo.Fields[findex]
+		var rules, _ = json.Marshal(field.Validate)
+		if hasRules[field.ElemStruct] {
+			fmt.Fprintf(w, "    %s: [%s, () => %sRules],\n", field.Name, rules, field.ElemStruct)
+		} else if field.Validate != "" && field.ElemStruct != "" {
+			// tells the client it's a struct rather than a map, so {} is not
+			// empty (see isEmptyValue in validate.go)
+			fmt.Fprintf(w, "    %s: [%s, null],\n", field.Name, rules)
+		} else if field.Validate != "" {
+			fmt.Fprintf(w, "    %s: %s,\n", field.Name, rules)
+		}
+	}
+	fmt.Fprintf(w, "};\n\n")
+}
+
+// WriteErrorCodeTSBinding writes a union type of all the error constants so
+// the client can switch on error codes with type checking
+func WriteErrorCodeTSBinding(b *Bridge, w io.Writer) {
+	if len(b.Errors) == 0 && b.Runtime == "" {
+		fmt.Fprintln(w, "export type ErrorCode = string;")
+		fmt.Fprintln(w)
+		return
+	}
+	fmt.Fprint(w, "export type ErrorCode =")
+	if b.Runtime != "" {
+		fmt.Fprintf(w, "\n    | %s", b.runtimeType("BuiltinErrorCode"))
+	}
+	for index := range b.Errors {
+		fmt.Fprintf(w, "\n    | typeof %s", b.Errors[index].Name)
 	}
+	fmt.Fprintln(w, ";")
+	fmt.Fprintln(w)
 }
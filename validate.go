@@ -0,0 +1,290 @@
+package vbeam
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ------------------------------------------
+// section: Input validation
+// ------------------------------------------
+//
+// Inputs are validated before the proc is called, according to struct tags:
+//
+//	Email string `json:"email" validate:"required,email"`
+//	Name  string `json:"name" validate:"required,min=3,max=64"`
+//	Role  string `json:"role" validate:"oneof=admin member"`
+//
+// Rules:
+//
+//	required   must not be empty (zero number, empty string/slice/map, nil pointer)
+//	min=N      strings: at least N characters; slices/maps: at least N items; numbers: at least N
+//	max=N      like min, for the upper bound
+//	email      must look like an email address
+//	oneof=A B  must be one of the space separated values
+//
+// Empty fields that are not required skip the other rules. Nested structs
+// (including pointers to and slices of structs) are validated too.
+//
+// The typescript bindings carry the same rules, and the generated client has
+// a validate function implementing them identically (same messages).
+
+var ValidationFailed = errors.New("ValidationFailed")
+
+var emailPattern = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+
+type validationRule struct {
+	name string
+	arg  string
+	num  float64 // parsed arg for min/max
+}
+
+type fieldValidator struct {
+	index  []int
+	name   string // json name
+	rules  []validationRule
+	nested *typeValidator // for struct, *struct and []struct fields
+}
+
+type typeValidator struct {
+	fields []fieldValidator
+}
+
+// validators are compiled once per type, usually at registration time
+var compiledValidators = make(map[reflect.Type]*typeValidator)
+var compiledValidatorsMu sync.Mutex
+
+// compileValidator returns nil if the type has no validation rules at all.
+// It panics on invalid tags, so mistakes are caught when the proc is registered.
+func compileValidator(t reflect.Type) *typeValidator {
+	compiledValidatorsMu.Lock()
+	defer compiledValidatorsMu.Unlock()
+	return compileValidatorLocked(t)
+}
+
+func compileValidatorLocked(t reflect.Type) *typeValidator {
+	t = structElem(t)
+	if t == nil {
+		return nil
+	}
+	if v, ok := compiledValidators[t]; ok {
+		return v
+	}
+	var v = new(typeValidator)
+	compiledValidators[t] = v // placeholder for recursive types
+	v.addFields(t, nil)
+	if len(v.fields) == 0 {
+		compiledValidators[t] = nil
+		return nil
+	}
+	return v
+}
+
+// structElem returns the struct type behind pointers, slices and arrays
+func structElem(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil
+	}
+	return t
+}
+
+func (v *typeValidator) addFields(t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		var field = t.Field(i)
+		var fieldIndex = append(append([]int{}, index...), i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			v.addFields(field.Type, fieldIndex)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		var name = field.Name
+		if jsonTag := field.Tag.Get("json"); jsonTag != "" {
+			var parts = strings.Split(jsonTag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+		}
+
+		var fv = fieldValidator{index: fieldIndex, name: name}
+		if tag := field.Tag.Get("validate"); tag != "" {
+			for _, part := range strings.Split(tag, ",") {
+				fv.rules = append(fv.rules, parseValidationRule(t, field.Name, part))
+			}
+		}
+		fv.nested = compileValidatorLocked(field.Type)
+		if len(fv.rules) > 0 || fv.nested != nil {
+			v.fields = append(v.fields, fv)
+		}
+	}
+}
+
+func parseValidationRule(t reflect.Type, fieldName string, text string) validationRule {
+	var rule validationRule
+	rule.name, rule.arg, _ = strings.Cut(strings.TrimSpace(text), "=")
+	switch rule.name {
+	case "required", "email", "oneof":
+	case "min", "max":
+		var err error
+		rule.num, err = strconv.ParseFloat(rule.arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid validate tag on %s.%s: %q needs a number", t.Name(), fieldName, text))
+		}
+	default:
+		panic(fmt.Sprintf("invalid validate tag on %s.%s: unknown rule %q", t.Name(), fieldName, text))
+	}
+	return rule
+}
+
+// Validate checks the value against the validation tags of its type. It
+// returns an *Error with ValidationFailed as the code and an entry per
+// invalid field, or nil.
+func Validate(value any) error {
+	var rv = reflect.ValueOf(value)
+	if !rv.IsValid() {
+		return nil
+	}
+	return validateValue(compileValidator(rv.Type()), rv)
+}
+
+func validateValue(v *typeValidator, value reflect.Value) error {
+	if v == nil {
+		return nil
+	}
+	var fields = make(map[string]string)
+	v.validate(value, "", fields)
+	if len(fields) == 0 {
+		return nil
+	}
+	var e = AsError(ValidationFailed)
+	e.Fields = fields
+	return e
+}
+
+func (v *typeValidator) validate(value reflect.Value, prefix string, errs map[string]string) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	for _, fv := range v.fields {
+		var path = prefix + fv.name
+		var fieldValue = value.FieldByIndex(fv.index)
+		if msg := checkValidationRules(fieldValue, fv.rules); msg != "" {
+			errs[path] = msg
+			continue
+		}
+		if fv.nested != nil {
+			fv.nested.validateNested(fieldValue, path, errs)
+		}
+	}
+}
+
+func (v *typeValidator) validateNested(value reflect.Value, path string, errs map[string]string) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			v.validateNested(value.Elem(), path, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			v.validateNested(value.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Struct:
+		v.validate(value, path+".", errs)
+	}
+}
+
+// structs are never empty, so "required" on a struct (not a pointer) always
+// passes; the TS client follows the same rule (see rpc_client.ts)
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	case reflect.Struct:
+		return false
+	default:
+		return value.IsZero()
+	}
+}
+
+// checkValidationRules returns the error message for the first failing rule
+func checkValidationRules(value reflect.Value, rules []validationRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	if isEmptyValue(value) {
+		for _, rule := range rules {
+			if rule.name == "required" {
+				return "is required"
+			}
+		}
+		return ""
+	}
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+
+	for _, rule := range rules {
+		switch rule.name {
+		case "min", "max":
+			var size float64
+			var unit string
+			switch value.Kind() {
+			case reflect.String:
+				size = float64(utf8.RuneCountInString(value.String()))
+				unit = " characters"
+			case reflect.Slice, reflect.Array, reflect.Map:
+				size = float64(value.Len())
+				unit = " items"
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				size = float64(value.Int())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				size = float64(value.Uint())
+			case reflect.Float32, reflect.Float64:
+				size = value.Float()
+			default:
+				continue
+			}
+			if rule.name == "min" && size < rule.num {
+				return "must be at least " + rule.arg + unit
+			}
+			if rule.name == "max" && size > rule.num {
+				return "must be at most " + rule.arg + unit
+			}
+		case "email":
+			if !emailPattern.MatchString(fmt.Sprint(value.Interface())) {
+				return "must be a valid email"
+			}
+		case "oneof":
+			var options = strings.Fields(rule.arg)
+			var found = false
+			for _, option := range options {
+				if fmt.Sprint(value.Interface()) == option {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "must be one of: " + strings.Join(options, ", ")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package vbeam
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type testPrefs struct {
+	Theme string `json:"theme"`
+}
+
+type testSignup struct {
+	Email     string        `json:"email" validate:"required,email"`
+	Name      string        `json:"name" validate:"required,min=3,max=8"`
+	Role      string        `json:"role" validate:"oneof=admin member"`
+	Age       int           `json:"age" validate:"min=18"`
+	Tags      []string      `json:"tags" validate:"max=2"`
+	Nickname  string        `json:"nickname" validate:"min=2"`
+	Address   *testAddress  `json:"address"`
+	Addresses []testAddress `json:"addresses"`
+	Prefs     testPrefs     `json:"prefs" validate:"required"`
+}
+
+func validSignup() testSignup {
+	return testSignup{Email: "a@example.com", Name: "Alice", Role: "admin", Age: 30}
+}
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		name   string
+		modify func(s *testSignup)
+		fields map[string]string
+	}{
+		{"valid", func(s *testSignup) {}, nil},
+		{"required", func(s *testSignup) { s.Email = "" }, map[string]string{"email": "is required"}},
+		{"email", func(s *testSignup) { s.Email = "nope" }, map[string]string{"email": "must be a valid email"}},
+		{"min length", func(s *testSignup) { s.Name = "Al" }, map[string]string{"name": "must be at least 3 characters"}},
+		{"max length counts runes", func(s *testSignup) { s.Name = "éééééééé" }, nil},
+		{"max length", func(s *testSignup) { s.Name = "Alexandria" }, map[string]string{"name": "must be at most 8 characters"}},
+		{"oneof", func(s *testSignup) { s.Role = "owner" }, map[string]string{"role": "must be one of: admin, member"}},
+		{"min number", func(s *testSignup) { s.Age = 17 }, map[string]string{"age": "must be at least 18"}},
+		{"max items", func(s *testSignup) { s.Tags = []string{"a", "b", "c"} }, map[string]string{"tags": "must be at most 2 items"}},
+		{"zero struct is not empty", func(s *testSignup) { s.Prefs = testPrefs{} }, nil},
+		{"empty optional fields skip rules", func(s *testSignup) { s.Nickname = ""; s.Role = "" }, nil},
+		{"nested pointer", func(s *testSignup) { s.Address = &testAddress{} }, map[string]string{"address.city": "is required"}},
+		{"nested slice", func(s *testSignup) { s.Addresses = []testAddress{{City: "x"}, {}} }, map[string]string{"addresses[1].city": "is required"}},
+		{"several fields", func(s *testSignup) { s.Email = ""; s.Age = 1 }, map[string]string{"email": "is required", "age": "must be at least 18"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input = validSignup()
+			test.modify(&input)
+			var err = Validate(input)
+			if test.fields == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || AsError(err).Code != "ValidationFailed" {
+				t.Fatalf("expected ValidationFailed, got %v", err)
+			}
+			if fields := AsError(err).Fields; !reflect.DeepEqual(fields, test.fields) {
+				t.Fatalf("expected field errors %v, got %v", test.fields, fields)
+			}
+		})
+	}
+}
+
+func TestValidateInvalidTagPanics(t *testing.T) {
+	type badRule struct {
+		Name string `validate:"requird"`
+	}
+	type badNumber struct {
+		Name string `validate:"min=three"`
+	}
+	for _, value := range []any{badRule{}, badNumber{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic for %T", value)
+				}
+			}()
+			Validate(value)
+		}()
+	}
+}
+
+var signupCalls int
+
+func Signup(ctx *Context, input testSignup) (string, error) {
+	signupCalls++
+	return input.Email, nil
+}
+
+func TestProcInputIsValidatedBeforeTheCall(t *testing.T) {
+	var app = newTestApp(t)
+	RegisterProc(app, Signup)
+	signupCalls = 0
+
+	var input = validSignup()
+	input.Email = "nope"
+	_, err := Call(app, "Signup", "", input)
+	if AsError(err).Fields["email"] == "" {
+		t.Fatalf("expected an email field error, got %v", err)
+	}
+	if signupCalls != 0 {
+		t.Fatal("proc was called with an invalid input")
+	}
+
+	if _, err := Call(app, "Signup", "", validSignup()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if signupCalls != 1 {
+		t.Fatal("proc was not called with a valid input")
+	}
+}
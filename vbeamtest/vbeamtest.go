@@ -0,0 +1,200 @@
+// Package vbeamtest is a harness for testing vbeam applications.
+//
+// It creates an Application backed by a temporary vbolt database and an
+// httptest server, and tears everything down at the end of the test.
+//
+//	func TestCreateUser(t *testing.T) {
+//		h := vbeamtest.New(t, "myapp", server.RegisterProcs)
+//		h.Seed(func(tx *vbolt.Tx) { ... })
+//
+//		user, err := vbeamtest.Invoke(h.WithToken(adminToken), server.CreateUser, req)
+//		vbeamtest.AssertNoError(t, err)
+//
+//		_, err = vbeamtest.InvokeHTTP(h, server.CreateUser, req)
+//		vbeamtest.AssertErrorCode(t, err, "EmailTaken")
+//	}
+package vbeamtest
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.hasen.dev/vbeam"
+	"go.hasen.dev/vbolt"
+)
+
+type Harness struct {
+	T      testing.TB
+	App    *vbeam.Application
+	DB     *vbolt.DB
+	Server *httptest.Server
+
+	// sent with every call made through this harness
+	Token string
+}
+
+// New creates an application with a fresh database and serves it over http.
+// register is called to register procs (and anything else the app needs)
+// before the server starts.
+func New(t testing.TB, name string, register func(app *vbeam.Application)) *Harness {
+	t.Helper()
+	var db = vbolt.Open(filepath.Join(t.TempDir(), name+".db"))
+	var app = vbeam.NewApplication(name, db)
+	if register != nil {
+		register(app)
+	}
+	var server = httptest.NewServer(app)
+
+	// registered after TempDir, so it runs before the directory is removed
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+
+	return &Harness{T: t, App: app, DB: db, Server: server}
+}
+
+// WithToken returns a harness for the same app that makes its calls with the
+// given auth token
+func (h *Harness) WithToken(token string) *Harness {
+	var n = *h
+	n.Token = token
+	return &n
+}
+
+// Seed runs fn in a write transaction and commits it
+func (h *Harness) Seed(fn func(tx *vbolt.Tx)) {
+	h.T.Helper()
+	var tx = vbolt.WriteTx(h.DB)
+	var committed = false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	fn(tx)
+	if err := tx.Commit(); err != nil {
+		h.T.Fatalf("vbeamtest: seed commit failed: %v", err)
+	}
+	committed = true
+}
+
+// View runs fn in a read transaction, for checking what procs wrote
+func (h *Harness) View(fn func(tx *vbolt.Tx)) {
+	var tx = vbolt.ReadTx(h.DB)
+	defer vbolt.TxClose(tx)
+	fn(tx)
+}
+
+// Call calls a proc by name in-process
+func (h *Harness) Call(procName string, input any) (any, error) {
+	return vbeam.Call(h.App, procName, h.Token, input)
+}
+
+// CallHTTP calls a proc by name over http and decodes the result into output
+// (which may be nil). Failed calls return a *vbeam.Error decoded from the
+// response.
+func (h *Harness) CallHTTP(procName string, input any, output any) error {
+	h.T.Helper()
+	body, err := json.Marshal(input)
+	if err != nil {
+		h.T.Fatalf("vbeamtest: could not encode input for %s: %v", procName, err)
+	}
+	req, err := http.NewRequest("POST", h.Server.URL+vbeam.PREFIX_RPC+procName, bytes.NewReader(body))
+	if err != nil {
+		h.T.Fatalf("vbeamtest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Token != "" {
+		req.Header.Set("x-auth-token", h.Token)
+	}
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		h.T.Fatalf("vbeamtest: request to %s failed: %v", procName, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.T.Fatalf("vbeamtest: reading response of %s failed: %v", procName, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e vbeam.Error
+		if err := json.Unmarshal(respBody, &e); err != nil {
+			e.Code = string(respBody)
+		}
+		e.Status = resp.StatusCode
+		return &e
+	}
+
+	if output == nil {
+		return nil
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		switch out := output.(type) {
+		case *string:
+			*out = string(respBody)
+			return nil
+		case encoding.TextUnmarshaler:
+			if err := out.UnmarshalText(respBody); err != nil {
+				h.T.Fatalf("vbeamtest: could not decode output of %s: %v", procName, err)
+			}
+			return nil
+		}
+	}
+	if err := json.Unmarshal(respBody, output); err != nil {
+		h.T.Fatalf("vbeamtest: could not decode output of %s: %v", procName, err)
+	}
+	return nil
+}
+
+// Invoke calls a proc in-process with type checking
+func Invoke[Input, Output any](h *Harness, proc func(*vbeam.Context, Input) (Output, error), input Input) (Output, error) {
+	return vbeam.Invoke(h.App, proc, h.Token, input)
+}
+
+// InvokeHTTP calls a proc over http with type checking
+func InvokeHTTP[Input, Output any](h *Harness, proc func(*vbeam.Context, Input) (Output, error), input Input) (output Output, err error) {
+	err = h.CallHTTP(vbeam.ProcName(proc), input, &output)
+	return
+}
+
+func AssertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// AssertErrorCode checks that err is a vbeam error (or converts to one) with
+// the given code
+func AssertErrorCode(t testing.TB, err error, code string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected error %q, got nil", code)
+	}
+	var e = vbeam.AsError(err)
+	if e.Code != code {
+		t.Fatalf("expected error %q, got %q (%s)", code, e.Code, e.Message)
+	}
+}
+
+// AssertFieldError checks that err has an error attached to the given field
+func AssertFieldError(t testing.TB, err error, field string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected error on field %q, got nil", field)
+	}
+	var e = vbeam.AsError(err)
+	if _, ok := e.Fields[field]; !ok {
+		t.Fatalf("expected error on field %q, got %q with fields %v", field, e.Code, e.Fields)
+	}
+}
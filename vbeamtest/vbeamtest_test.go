@@ -0,0 +1,124 @@
+package vbeamtest_test
+
+import (
+	"errors"
+	"testing"
+
+	"go.hasen.dev/vbeam"
+	"go.hasen.dev/vbeam/vbeamtest"
+	"go.hasen.dev/vbolt"
+	"go.hasen.dev/vpack"
+)
+
+var dbInfo vbolt.Info
+
+// email -> name
+var usersBucket = vbolt.Bucket(&dbInfo, "users", vpack.StringZ, vpack.String)
+
+var EmailTaken = errors.New("EmailTaken")
+
+type CreateUserRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	Name  string `json:"name"`
+}
+
+type CreateUserResponse struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+func CreateUser(ctx *vbeam.Context, req CreateUserRequest) (resp CreateUserResponse, err error) {
+	var name string
+	if vbolt.Read(ctx.Tx, usersBucket, req.Email, &name) {
+		return resp, EmailTaken
+	}
+	vbeam.UseWriteTx(ctx)
+	vbolt.Write(ctx.Tx, usersBucket, req.Email, &req.Name)
+	return CreateUserResponse{Email: req.Email, Name: req.Name}, nil
+}
+
+type Empty struct{}
+
+func WhoAmI(ctx *vbeam.Context, input Empty) (string, error) {
+	return ctx.Token, nil
+}
+
+func registerProcs(app *vbeam.Application) {
+	vbolt.InitBuckets(app.DB, &dbInfo)
+	vbeam.RegisterProc(app, CreateUser)
+	vbeam.RegisterProc(app, WhoAmI)
+}
+
+func TestInvoke(t *testing.T) {
+	h := vbeamtest.New(t, "testapp", registerProcs)
+
+	resp, err := vbeamtest.Invoke(h, CreateUser, CreateUserRequest{Email: "a@example.com", Name: "A"})
+	vbeamtest.AssertNoError(t, err)
+	if resp.Name != "A" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	var name string
+	h.View(func(tx *vbolt.Tx) {
+		vbolt.Read(tx, usersBucket, "a@example.com", &name)
+	})
+	if name != "A" {
+		t.Fatalf("user was not stored, got %q", name)
+	}
+
+	_, err = vbeamtest.Invoke(h, CreateUser, CreateUserRequest{Email: "a@example.com", Name: "B"})
+	vbeamtest.AssertErrorCode(t, err, "EmailTaken")
+}
+
+func TestInvokeHTTP(t *testing.T) {
+	h := vbeamtest.New(t, "testapp", registerProcs)
+
+	resp, err := vbeamtest.InvokeHTTP(h, CreateUser, CreateUserRequest{Email: "a@example.com", Name: "A"})
+	vbeamtest.AssertNoError(t, err)
+	if resp.Email != "a@example.com" || resp.Name != "A" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	_, err = vbeamtest.InvokeHTTP(h, CreateUser, CreateUserRequest{Email: "a@example.com", Name: "B"})
+	vbeamtest.AssertErrorCode(t, err, "EmailTaken")
+
+	_, err = vbeamtest.InvokeHTTP(h, CreateUser, CreateUserRequest{Email: "not an email"})
+	vbeamtest.AssertFieldError(t, err, "email")
+}
+
+func TestSeed(t *testing.T) {
+	h := vbeamtest.New(t, "testapp", registerProcs)
+	h.Seed(func(tx *vbolt.Tx) {
+		var name = "Seeded"
+		vbolt.Write(tx, usersBucket, "seeded@example.com", &name)
+	})
+
+	_, err := h.Call("CreateUser", CreateUserRequest{Email: "seeded@example.com", Name: "B"})
+	vbeamtest.AssertErrorCode(t, err, "EmailTaken")
+
+	err = h.CallHTTP("CreateUser", CreateUserRequest{Email: "seeded@example.com", Name: "B"}, nil)
+	vbeamtest.AssertErrorCode(t, err, "EmailTaken")
+}
+
+func TestWithToken(t *testing.T) {
+	h := vbeamtest.New(t, "testapp", registerProcs)
+
+	token, err := vbeamtest.Invoke(h.WithToken("secret"), WhoAmI, Empty{})
+	vbeamtest.AssertNoError(t, err)
+	if token != "secret" {
+		t.Fatalf("expected the harness token, got %q", token)
+	}
+
+	// string outputs come back as text/plain over http
+	token, err = vbeamtest.InvokeHTTP(h.WithToken("secret"), WhoAmI, Empty{})
+	vbeamtest.AssertNoError(t, err)
+	if token != "secret" {
+		t.Fatalf("expected the harness token over http, got %q", token)
+	}
+
+	token, err = vbeamtest.Invoke(h, WhoAmI, Empty{})
+	vbeamtest.AssertNoError(t, err)
+	if token != "" {
+		t.Fatalf("expected no token, got %q", token)
+	}
+}
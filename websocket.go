@@ -0,0 +1,401 @@
+package vbeam
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ------------------------------------------
+// section: WebSocket transport
+// ------------------------------------------
+//
+// An optional single websocket endpoint that multiplexes proc calls and lets
+// the server push named events to subscribed clients.
+//
+// All messages are json text frames. Client to server:
+//
+//	{"id": 1, "type": "call", "proc": "ProcName", "input": {...}}
+//	{"type": "subscribe", "event": "name"}
+//	{"type": "unsubscribe", "event": "name"}
+//
+// Server to client:
+//
+//	{"id": 1, "type": "result", "data": ...}
+//	{"id": 1, "type": "error", "error": {...}}
+//	{"type": "event", "event": "name", "data": ...}
+//
+// Each call gets its own Context (and transaction) made from the upgrade
+// request, so the token comes from the x-auth-token header or the authToken
+// cookie, exactly like a regular http call. Messages can't change it; a client
+// that logs in or out should reconnect.
+//
+// A connection runs at most wsMaxCallsInFlight calls at once; further calls
+// wait for one of them to finish before being read.
+
+const PATH_WEBSOCKET = "/ws"
+
+const wsMaxCallsInFlight = 16
+
+type wsMessage struct {
+	Id    int64           `json:"id,omitempty"`
+	Type  string          `json:"type"`
+	Proc  string          `json:"proc,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	Data  any             `json:"data,omitempty"`
+	Error *Error          `json:"error,omitempty"`
+}
+
+type wsHub struct {
+	mu    sync.Mutex
+	conns map[*wsConn]bool
+}
+
+// EnableWebSocket serves the websocket endpoint at PATH_WEBSOCKET
+func (app *Application) EnableWebSocket() {
+	app.HandleFunc(PATH_WEBSOCKET, app.HandleWebSocket)
+}
+
+// Publish pushes an event to all websocket clients subscribed to it
+func (app *Application) Publish(event string, data any) {
+	msg, err := json.Marshal(wsMessage{Type: "event", Event: event, Data: data})
+	if err != nil {
+		log.Println("websocket: could not encode event", event, err)
+		return
+	}
+	var subscribers []*wsConn
+	app.ws.mu.Lock()
+	for c := range app.ws.conns {
+		if c.isSubscribed(event) {
+			subscribers = append(subscribers, c)
+		}
+	}
+	app.ws.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.writeFrame(wsOpText, msg)
+	}
+}
+
+func (app *Application) HandleWebSocket(w http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" ||
+		!headerHasToken(request.Header, "Connection", "upgrade") ||
+		!headerHasToken(request.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a websocket upgrade", 400)
+		return
+	}
+	var key = request.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", 400)
+		return
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	// browsers let any page open a websocket to us, with our cookies
+	if err := app.checkCSRFOrigin(request); err != nil {
+		RespondError(w, err)
+		return
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Websocket not supported", 500)
+		return
+	}
+	defer netConn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(rw, "Upgrade: websocket\r\n")
+	fmt.Fprintf(rw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	if ww, ok := w.(*ResponseWriter); ok {
+		ww.statusCode = http.StatusSwitchingProtocols
+	}
+
+	var c = &wsConn{
+		app:     app,
+		request: request,
+		conn:    netConn,
+		reader:  rw.Reader,
+		writer:  rw.Writer,
+		events:  make(map[string]bool),
+	}
+	c.ctx, c.cancel = context.WithCancel(request.Context())
+
+	app.ws.mu.Lock()
+	app.ws.conns[c] = true
+	app.ws.mu.Unlock()
+	defer func() {
+		app.ws.mu.Lock()
+		delete(app.ws.conns, c)
+		app.ws.mu.Unlock()
+	}()
+
+	c.readLoop()
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAcceptKey(key string) string {
+	var h = sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+var wsMessageTooBig = errors.New("websocket message too big")
+var wsUnmaskedFrame = errors.New("websocket frame from the client is not masked")
+
+// close status codes
+const (
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+type wsConn struct {
+	app     *Application
+	request *http.Request
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	eventsMu sync.Mutex
+	events   map[string]bool
+}
+
+func (c *wsConn) isSubscribed(event string) bool {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	return c.events[event]
+}
+
+func (c *wsConn) readLoop() {
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	defer c.cancel() // cancel calls in flight before waiting for them
+	var slots = make(chan struct{}, wsMaxCallsInFlight)
+
+	for {
+		op, payload, err := c.readMessage()
+		if err != nil || op == wsOpClose {
+			c.writeFrame(wsOpClose, wsClosePayload(err))
+			return
+		}
+		if op != wsOpText {
+			continue
+		}
+		var msg wsMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			c.send(wsMessage{Type: "error", Error: AsError(InvalidRequest)})
+			continue
+		}
+		switch msg.Type {
+		case "call":
+			slots <- struct{}{}
+			calls.Add(1)
+			go func() {
+				defer calls.Done()
+				defer func() { <-slots }()
+				c.handleCall(&msg)
+			}()
+		case "subscribe":
+			if err := c.checkSubscribe(&msg); err != nil {
+				c.send(wsMessage{Type: "error", Event: msg.Event, Error: AsError(err)})
+				continue
+			}
+			c.eventsMu.Lock()
+			c.events[msg.Event] = true
+			c.eventsMu.Unlock()
+		case "unsubscribe":
+			c.eventsMu.Lock()
+			delete(c.events, msg.Event)
+			c.eventsMu.Unlock()
+		}
+	}
+}
+
+func (c *wsConn) checkSubscribe(msg *wsMessage) error {
+	if c.app.SubscribeCheck == nil {
+		return nil
+	}
+	var ctx = MakeContext(c.app, c.request)
+	defer CloseContext(&ctx)
+	return c.app.SubscribeCheck(&ctx, msg.Event)
+}
+
+func (c *wsConn) handleCall(msg *wsMessage) {
+	output, err := c.callProc(msg)
+	if err != nil {
+		c.send(wsMessage{Id: msg.Id, Type: "error", Error: AsError(err)})
+	} else {
+		c.send(wsMessage{Id: msg.Id, Type: "result", Data: outputData(output)})
+	}
+}
+
+func (c *wsConn) callProc(msg *wsMessage) (output any, err error) {
+	// we're not under the http handler, so a panic would take down the server
+	defer func() {
+		if crash := recover(); crash != nil {
+			var buf strings.Builder
+			warningRed.Fprintf(&buf, "websocket call to %s panicked: %v\n", msg.Proc, crash)
+			PrintUsefulStackTrace(&buf)
+			log.Print(buf.String())
+			output, err = nil, InternalServerError
+		}
+	}()
+
+	return c.app.callJSONProc(c.request, msg.Proc, msg.Input, func(ctx *Context) {
+		ctx.Context = c.ctx
+	})
+}
+
+func (c *wsConn) send(msg wsMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data, _ = json.Marshal(wsMessage{Id: msg.Id, Type: "error", Error: AsError(err)})
+	}
+	c.writeFrame(wsOpText, data)
+}
+
+// readMessage reads a complete (possibly fragmented) message, answering pings
+// along the way
+func (c *wsConn) readMessage() (op byte, message []byte, err error) {
+	for {
+		var header [2]byte
+		if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+			return
+		}
+		var fin = header[0]&0x80 != 0
+		var frameOp = header[0] & 0x0F
+		var masked = header[1]&0x80 != 0
+		var length = uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		// length comes from the client; adding to it could overflow
+		if length > uint64(DefaultMaxBytes-len(message)) {
+			err = wsMessageTooBig
+			return
+		}
+		if !masked { // required from clients by RFC 6455
+			err = wsUnmaskedFrame
+			return
+		}
+		var mask [4]byte
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+		var payload = make([]byte, length)
+		if _, err = io.ReadFull(c.reader, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch frameOp {
+		case wsOpClose:
+			return wsOpClose, payload, nil
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpContinuation:
+			message = append(message, payload...)
+		default:
+			op = frameOp
+			message = payload
+		}
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+// wsClosePayload tells the client why we're closing the connection
+func wsClosePayload(err error) []byte {
+	var code uint16
+	switch err {
+	case wsMessageTooBig:
+		code = wsCloseTooBig
+	case wsUnmaskedFrame:
+		code = wsCloseProtocolError
+	default:
+		return nil
+	}
+	return binary.BigEndian.AppendUint16(nil, code)
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var header = []byte{0x80 | op}
+	var n = len(payload)
+	switch {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.writer.Write(header)
+	c.writer.Write(payload)
+	return c.writer.Flush()
+}